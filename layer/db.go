@@ -3,57 +3,205 @@ package layer
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/suconghou/cachelayer/store"
+	"github.com/suconghou/cachelayer/util"
 )
 
 var (
-	bData       = []byte("data")
-	storeHeader = []string{"Content-Type", "Accept-Ranges"}
+	bMeta = []byte("meta")
+	// storeHeader 是 vhost 未配置 headers 时默认保存到元信息中的响应头
+	storeHeader = []string{"Content-Type", "Accept-Ranges", "ETag", "Last-Modified", "Content-Disposition", "Content-Encoding", "Cache-Control"}
 )
 
 type ObjectMeta struct {
-	Length int64       `json:"length"`
-	Header http.Header `json:"header"`
+	Length    int64       `json:"length"`
+	ChunkSize int64       `json:"chunkSize,omitempty"` // 对象缓存时使用的分片大小，之后修改配置不影响已缓存的对象
+	Header    http.Header `json:"header"`
+
+	// 探测时上游返回的校验信息，之后回源填充分片时用于确认上游对象没有变化
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+
+	// 新鲜期截止的时间戳，0 表示一直新鲜；过期后对象仍保留在存储中，经上游确认未变化后可继续使用
+	Expires int64 `json:"expires,omitempty"`
+
+	// 上游响应的 Vary，Index 为 true 时表示这是 URL 下的变体索引，真正的对象按 Vary 的请求头取值分别存储
+	Vary  []string `json:"vary,omitempty"`
+	Index bool     `json:"index,omitempty"`
+
+	// 缓存的上游错误响应（负缓存）的状态码及截断后的响应体，Status 为 0 表示正常对象
+	Status int    `json:"status,omitempty"`
+	Body   []byte `json:"body,omitempty"`
+
+	// 上游不允许缓存（no-store、private 等），新鲜期内的请求不再探测而直接回源
+	Pass bool `json:"pass,omitempty"`
+}
+
+// NewObjectMeta 根据上游响应头创建元信息，keep 为需要保存的响应头，nil 时使用默认列表，ttl 为新鲜期（单位：秒），ttl<=0 表示一直新鲜
+func NewObjectMeta(ll int64, chunkSize int64, h http.Header, keep []string, ttl int64) *ObjectMeta {
+	var m = http.Header{}
+	if keep == nil {
+		keep = storeHeader
+	}
+	for _, k := range keep {
+		k = http.CanonicalHeaderKey(k)
+		if k == "Content-Length" || k == "Content-Range" { // 每次响应时根据请求范围生成
+			continue
+		}
+		if v := h.Values(k); len(v) > 0 {
+			m[k] = append([]string(nil), v...)
+		}
+	}
+	var om = &ObjectMeta{
+		Length:       ll,
+		ChunkSize:    chunkSize,
+		Header:       m,
+		ETag:         h.Get("ETag"),
+		LastModified: h.Get("Last-Modified"),
+		Vary:         util.Vary(h),
+	}
+	om.Refresh(ttl)
+	return om
+}
+
+// Refresh 从现在起重新计算新鲜期
+func (om *ObjectMeta) Refresh(ttl int64) {
+	om.Expires = 0
+	if ttl > 0 {
+		om.Expires = time.Now().Unix() + ttl
+	}
+}
+
+// Stale 检查对象是否已过新鲜期，需要向上游重新验证
+func (om *ObjectMeta) Stale() bool {
+	return om.Expires > 0 && om.Expires <= time.Now().Unix()
+}
+
+// Overdue 返回对象已过新鲜期多少秒
+func (om *ObjectMeta) Overdue() int64 {
+	if om.Expires <= 0 {
+		return 0
+	}
+	return time.Now().Unix() - om.Expires
+}
+
+// Conditional 设置重新验证用的条件请求头，没有任何校验信息时返回 false
+func (om *ObjectMeta) Conditional(h http.Header) bool {
+	if om.ETag != "" {
+		h.Set("If-None-Match", om.ETag)
+	}
+	if om.LastModified != "" {
+		h.Set("If-Modified-Since", om.LastModified)
+	}
+	return om.ETag != "" || om.LastModified != ""
+}
+
+// Clone 返回元信息的副本，多个请求共享同一份元信息时各自修改副本的响应头
+func (om *ObjectMeta) Clone() *ObjectMeta {
+	c := *om
+	c.Header = om.Header.Clone()
+	return &c
+}
+
+// IfRange 返回回源时 If-Range 请求头的值，弱 ETag 不能用于 If-Range，此时使用 Last-Modified
+func (om *ObjectMeta) IfRange() string {
+	if om.ETag != "" && !strings.HasPrefix(om.ETag, "W/") {
+		return om.ETag
+	}
+	return om.LastModified
+}
+
+// Validate 检查回源的范围响应是否仍是同一个对象，上游内容变化时返回 errChanged
+func (om *ObjectMeta) Validate(code int, h http.Header) error {
+	if code != http.StatusPartialContent {
+		return fmt.Errorf("%w: status %d", errChanged, code)
+	}
+	if l := util.GetLen(h.Get("Content-Range")); l != om.Length {
+		return fmt.Errorf("%w: length %d != %d", errChanged, l, om.Length)
+	}
+	if v := h.Get("ETag"); om.ETag != "" && v != "" && v != om.ETag {
+		return fmt.Errorf("%w: etag %s != %s", errChanged, v, om.ETag)
+	}
+	if v := h.Get("Last-Modified"); om.LastModified != "" && v != "" && v != om.LastModified {
+		return fmt.Errorf("%w: last-modified %s != %s", errChanged, v, om.LastModified)
+	}
+	return nil
 }
 
 // store 定义了缓存存储的接口
 type CacheStore interface {
-	// Set 将数据流存储到指定的 key，并设置 TTL（单位：秒）
-	Set([]byte, []byte, int64) error
+	// Set 将数据流存储到指定的 key，数据跟随对象一起过期
+	Set([]byte, []byte) error
 
 	// Get 从指定的 key 获取一个可读的数据流
 	// 返回的 io.ReadCloser 在读取完毕后应该被关闭
 	Get([]byte) ([]byte, error)
 
-	// Has 检查指定的 key 是否存在于缓存中,并延长有效期
-	Has([]byte, int64) bool
+	// Has 检查指定的 key 是否存在于缓存中
+	Has([]byte) bool
+
+	// Touch 记录一次访问并延长整个对象（元信息及全部分片）的有效期（单位：秒），只修改内存，由存储后端定时写入
+	Touch(int64)
+
+	// Remove 删除整个对象（元信息及全部分片）
+	Remove() error
+
+	// Key 返回对象标识
+	Key() []byte
+
+	// LoadMeta 读取对象的元信息，不存在时返回 nil
+	LoadMeta() (*ObjectMeta, error)
+
+	// SetMeta 保存对象的元信息，并设置整个对象在存储中的保留时间（单位：秒），保留时间包含新鲜期及之后可供重新验证的时间
+	SetMeta(*ObjectMeta, int64) error
 }
 
 type kvstore struct {
+	backend store.Backend
 	baseKey []byte
 }
 
-func (k *kvstore) Set(key []byte, b []byte, ttl int64) error {
-	return store.TTLSet(bData, bytes.Join([][]byte{k.baseKey, key}, []byte(":")), b, ttl)
+func (k *kvstore) key(key []byte) []byte {
+	return bytes.Join([][]byte{k.baseKey, key}, []byte(":"))
+}
+
+func (k *kvstore) Set(key []byte, b []byte) error {
+	return k.backend.Set(k.key(key), b)
 }
 
 func (k *kvstore) Get(key []byte) ([]byte, error) {
-	return store.Get(bData, bytes.Join([][]byte{k.baseKey, key}, []byte(":")))
+	return k.backend.Get(k.key(key))
 }
 
-func (k *kvstore) Has(key []byte, ttl int64) bool {
-	v, err := store.Touch(bData, bytes.Join([][]byte{k.baseKey, key}, []byte(":")), ttl)
+func (k *kvstore) Has(key []byte) bool {
+	v, err := k.backend.Has(k.key(key))
 	return v && err == nil
 }
 
-func NewCacheStore(baseKey []byte) CacheStore {
-	return &kvstore{baseKey}
+func (k *kvstore) Key() []byte {
+	return k.baseKey
 }
 
-func LoadMeta(key []byte) (*ObjectMeta, error) {
-	b, err := store.Get(bData, key)
+func (k *kvstore) Remove() error {
+	return k.backend.Remove(k.baseKey)
+}
+
+func (k *kvstore) Touch(ttl int64) {
+	k.backend.Touch(k.baseKey, ttl)
+}
+
+// NewCacheStore 返回对象级别的存储，baseKey 为对象标识，所有分片及元信息都以它为前缀存入 backend
+func NewCacheStore(backend store.Backend, baseKey []byte) CacheStore {
+	return &kvstore{backend, baseKey}
+}
+
+func (k *kvstore) LoadMeta() (*ObjectMeta, error) {
+	b, err := k.Get(bMeta)
 	if err != nil {
 		return nil, err
 	}
@@ -61,23 +209,22 @@ func LoadMeta(key []byte) (*ObjectMeta, error) {
 		return nil, nil
 	}
 	var om ObjectMeta
-	return &om, json.Unmarshal(b, &om)
-}
-
-func SetMeta(key []byte, ll int64, h http.Header, ttl int64) (*ObjectMeta, error) {
-	var m = http.Header{}
-	for _, k := range storeHeader {
-		if v := h.Get(k); v != "" {
-			m.Set(k, v)
-		}
+	if err = json.Unmarshal(b, &om); err != nil {
+		return nil, err
 	}
-	var om = &ObjectMeta{
-		Length: ll,
-		Header: m,
+	if om.ChunkSize <= 0 { // 没有记录分片大小的旧对象使用默认大小
+		om.ChunkSize = ChunkSize
 	}
+	return &om, nil
+}
+
+func (k *kvstore) SetMeta(om *ObjectMeta, keep int64) error {
 	bs, err := json.Marshal(om)
 	if err != nil {
-		return om, err
+		return err
+	}
+	if err = k.Set(bMeta, bs); err != nil {
+		return err
 	}
-	return om, store.TTLSet(bData, key, bs, ttl)
+	return k.backend.SetTTL(k.baseKey, keep)
 }
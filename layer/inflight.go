@@ -0,0 +1,283 @@
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/suconghou/cachelayer/store"
+	"github.com/suconghou/cachelayer/util"
+)
+
+var (
+	errCanceled = errors.New("download canceled")
+	errChanged  = errors.New("upstream object changed")
+
+	flightsMu sync.Mutex
+	flights   = map[string]*flight{} // 正在下载中的分片，key 为 对象标识:分片序号
+)
+
+func flightKey(obj []byte, index int64) string {
+	return string(obj) + ":" + strconv.FormatInt(index, 10)
+}
+
+// flight 表示一个正在下载中的分片，已到达的数据可以被多个读取方同时读取
+type flight struct {
+	download *download
+	index    int64
+	key      string
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	data []byte // 已到达的数据，开始填充时按分片大小分配，只追加不重新分配
+	done bool
+	err  error
+}
+
+func (f *flight) finish(err error) {
+	f.mu.Lock()
+	f.done = true
+	f.err = err
+	f.mu.Unlock()
+	f.cond.Broadcast()
+	flightsMu.Lock()
+	if flights[f.key] == f {
+		delete(flights, f.key)
+	}
+	flightsMu.Unlock()
+}
+
+// fill 从上游读取 size 字节到分片中，每次读到数据都唤醒等待的读取方
+func (f *flight) fill(r io.Reader, size int) error {
+	f.mu.Lock()
+	f.data = make([]byte, 0, size)
+	f.mu.Unlock()
+	for {
+		f.mu.Lock()
+		l := len(f.data)
+		f.mu.Unlock()
+		if l >= size {
+			return nil
+		}
+		// 读取方只访问 data[:len]，因此可以在锁外直接写入 data[len:size]
+		n, err := r.Read(f.data[l:size])
+		if n > 0 {
+			f.mu.Lock()
+			f.data = f.data[:l+n]
+			f.mu.Unlock()
+			f.cond.Broadcast()
+		}
+		if err == io.EOF {
+			if l+n < size {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// flightReader 从下载中的分片读取数据，数据未到达时阻塞等待
+type flightReader struct {
+	flight *flight
+	offset int
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	f := r.flight
+	if f == nil {
+		return 0, io.EOF
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for r.offset >= len(f.data) && !f.done {
+		f.cond.Wait()
+	}
+	if r.offset < len(f.data) {
+		n := copy(p, f.data[r.offset:])
+		r.offset += n
+		return n, nil
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	r.flight = nil // 读完后不再引用分片数据
+	return 0, io.EOF
+}
+
+// download 是一次回源的范围请求，覆盖连续的若干个分片，在后台按上游速度写入各个分片
+// 所有读取到其中分片的 cacheLayer 都持有它的引用，引用全部释放后取消下载
+type download struct {
+	getter     getter
+	target     string
+	store      CacheStore
+	reqHeaders http.Header
+	meta       *ObjectMeta
+	flights    []*flight // 尚未存入缓存的分片，存入后置为 nil
+
+	mu       sync.Mutex
+	refs     int
+	body     io.ReadCloser
+	canceled bool
+	finished bool
+}
+
+// acquire 增加引用，下载已被取消时返回 false
+func (d *download) acquire() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.canceled {
+		return false
+	}
+	d.refs++
+	return true
+}
+
+// release 释放引用，最后一个引用释放且下载未完成时取消下载，关闭上游连接
+func (d *download) release() {
+	d.mu.Lock()
+	d.refs--
+	if d.refs > 0 {
+		d.mu.Unlock()
+		return
+	}
+	d.mu.Unlock()
+	d.cancel()
+}
+
+// cancel 取消尚未完成的下载，关闭上游连接，等待中的读取方收到 errCanceled
+func (d *download) cancel() {
+	d.mu.Lock()
+	if d.finished || d.canceled {
+		d.mu.Unlock()
+		return
+	}
+	d.canceled = true
+	body := d.body
+	pending := slices.Clone(d.flights)
+	d.mu.Unlock()
+	if body != nil {
+		body.Close()
+	}
+	flightsMu.Lock()
+	for _, f := range pending {
+		if f != nil && flights[f.key] == f {
+			delete(flights, f.key)
+		}
+	}
+	flightsMu.Unlock()
+}
+
+// invalidate 取消对象所有正在进行的下载，上游对象已变化时它们下载到的可能是旧版本，不能再写入缓存
+func invalidate(obj []byte) {
+	var (
+		prefix    = string(obj) + ":"
+		downloads []*download
+	)
+	flightsMu.Lock()
+	for key, f := range flights {
+		if strings.HasPrefix(key, prefix) && !slices.Contains(downloads, f.download) {
+			downloads = append(downloads, f.download)
+		}
+	}
+	flightsMu.Unlock()
+	for _, d := range downloads {
+		d.cancel()
+	}
+}
+
+// current 检查存储中的元信息是否仍是下载开始时的对象，对象已被删除或重新探测为新版本时不再写入分片
+func (d *download) current() bool {
+	m, err := d.store.LoadMeta()
+	return err == nil && m != nil && m.Length == d.meta.Length && m.ChunkSize == d.meta.ChunkSize &&
+		m.ETag == d.meta.ETag && m.LastModified == d.meta.LastModified
+}
+
+func (d *download) isCanceled() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.canceled
+}
+
+func (d *download) chunkLen(index int64) int {
+	return int(min(d.meta.ChunkSize, d.meta.Length-index*d.meta.ChunkSize))
+}
+
+func (d *download) run() {
+	var (
+		first   = d.flights[0].index
+		last    = d.flights[len(d.flights)-1].index
+		headers = d.reqHeaders.Clone()
+	)
+	headers.Set("Range", fmt.Sprintf("bytes=%d-%d", first*d.meta.ChunkSize, min((last+1)*d.meta.ChunkSize, d.meta.Length)-1))
+	if v := d.meta.IfRange(); v != "" { // 上游对象已变化时返回 200 完整内容，而不是新对象的片段
+		headers.Set("If-Range", v)
+	}
+	res, code, h, err := d.getter(d.target, headers) // 如果statusCode非200区间，则err有值
+	if err == nil {
+		err = d.meta.Validate(code, h)
+	}
+	if err != nil {
+		if res != nil {
+			res.Close()
+		}
+		if errors.Is(err, errChanged) { // 不能把新旧两个版本的分片拼在一起，删除整个对象，下次请求时重新探测
+			util.Log.Printf("%s %s, invalidate cache", d.target, err)
+			if e := d.store.Remove(); e != nil {
+				util.Log.Print(e)
+			}
+			invalidate(d.store.Key())
+		}
+		d.fail(0, err)
+		return
+	}
+	d.mu.Lock()
+	if d.canceled {
+		d.mu.Unlock()
+		res.Close()
+		d.fail(0, errCanceled)
+		return
+	}
+	d.body = res
+	d.mu.Unlock()
+	defer res.Close()
+	for i, f := range d.flights {
+		if err = f.fill(res, d.chunkLen(f.index)); err != nil {
+			if d.isCanceled() {
+				err = errCanceled
+			}
+			d.fail(i, err)
+			return
+		}
+		// 只有完整的分片才会存入缓存；对象已失效或已重新探测为新版本时，本次下载的读取方仍读到一致的旧内容，但不再写入
+		if d.current() {
+			if err = d.store.Set([]byte(strconv.FormatInt(f.index, 10)), f.data); err != nil && !errors.Is(err, store.ErrQueueFull) {
+				util.Log.Print(err) // 队列已满时由队列按次数打印，之后读到这个分片时再回源
+			}
+		}
+		f.finish(nil)
+		// 之后的读取方从缓存读取，下载不再引用这个分片，数据在已有的读取方读完后即可回收
+		d.mu.Lock()
+		d.flights[i] = nil
+		d.mu.Unlock()
+	}
+	d.mu.Lock()
+	d.finished = true
+	d.mu.Unlock()
+}
+
+// fail 以错误结束第 i 个及之后的分片
+func (d *download) fail(i int, err error) {
+	for _, f := range d.flights[i:] {
+		f.finish(err)
+	}
+	d.mu.Lock()
+	d.finished = true
+	d.mu.Unlock()
+}
@@ -0,0 +1,173 @@
+package layer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadSkipsReplacedObject(t *testing.T) {
+	var tests = []struct {
+		name    string
+		replace func(obj *Object) error // 下载开始前存储中的对象被删除或重新探测
+	}{
+		{"removed", func(obj *Object) error { return obj.store.Remove() }},
+		{"reprobed", func(obj *Object) error {
+			var h = http.Header{}
+			h.Set("ETag", `"v2"`)
+			return obj.store.SetMeta(NewObjectMeta(obj.meta.Length, testChunk, h, nil, 0), 0)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var etag atomic.Value
+			etag.Store(`"v1"`)
+			obj, content, _ := newTestObject(t, &etag, 0)
+			defer obj.Close()
+			if err := tt.replace(obj); err != nil {
+				t.Fatal(err)
+			}
+			var p = make([]byte, testChunk)
+			if _, err := obj.ReadAt(p, testChunk); err != nil || !bytes.Equal(p, content[testChunk:2*testChunk]) {
+				t.Fatalf("ReadAt = %v", err)
+			}
+			if obj.store.Has([]byte("1")) {
+				t.Fatal("chunk of the old version stored")
+			}
+		})
+	}
+}
+
+func TestInvalidateCancelsDownloads(t *testing.T) {
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	obj, _, _ := newTestObject(t, &etag, 0)
+	defer obj.Close()
+	var done = make(chan error, 1)
+	go func() {
+		_, err := obj.ReadAt(make([]byte, 2*testChunk), testChunk)
+		done <- err
+	}()
+	for deadline := time.Now().Add(5 * time.Second); !obj.open(testChunk, testChunk, 0).cached(1); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("download never started")
+		}
+	}
+	invalidate(obj.store.Key())
+	if err := <-done; !errors.Is(err, errCanceled) {
+		t.Fatalf("ReadAt error = %v, want %v", err, errCanceled)
+	}
+	flightsMu.Lock()
+	defer flightsMu.Unlock()
+	for key := range flights {
+		if strings.HasPrefix(key, string(obj.store.Key())+":") {
+			t.Fatalf("flight %s left after invalidate", key)
+		}
+	}
+}
+
+// waitDownload 等待分片开始下载
+func waitDownload(t *testing.T, obj *Object, index int64) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !obj.open(0, 0, 0).cached(index); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("chunk %d never started downloading", index)
+		}
+	}
+}
+
+func TestDownloadSharing(t *testing.T) {
+	var tests = []struct {
+		name    string
+		first   [2]int64 // 第一个读取方读取的 [off, off+n)
+		joiners [][2]int64
+	}{
+		{"same chunk", [2]int64{testChunk, testChunk}, [][2]int64{{testChunk, testChunk}, {testChunk + 100, 100}, {testChunk, testChunk}}},
+		{"inside window", [2]int64{testChunk, 2 * testChunk}, [][2]int64{{2 * testChunk, testChunk}, {2*testChunk + 10, 10}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var etag atomic.Value
+			etag.Store(`"v1"`)
+			obj, content, hits := newTestObject(t, &etag, 0)
+			defer obj.Close()
+			var (
+				wg   sync.WaitGroup
+				errs = make(chan error, len(tt.joiners)+1)
+			)
+			read := func(r [2]int64) {
+				defer wg.Done()
+				var p = make([]byte, r[1])
+				if _, err := obj.ReadAt(p, r[0]); err != nil {
+					errs <- err
+				} else if !bytes.Equal(p, content[r[0]:r[0]+r[1]]) {
+					errs <- fmt.Errorf("ReadAt(%d, %d) mismatch", r[0], r[1])
+				}
+			}
+			wg.Add(1)
+			go read(tt.first)
+			waitDownload(t, obj, tt.first[0]/testChunk)
+			for _, r := range tt.joiners { // 下载进行中的读取方直接加入，不再回源
+				wg.Add(1)
+				go read(r)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+			if n := hits.Load(); n != 1 {
+				t.Fatalf("upstream requests = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestDownloadCancel(t *testing.T) {
+	var tests = []struct {
+		name     string
+		keep     bool // 第一个读取方关闭时是否还有其他读取方持有下载
+		canceled bool
+	}{
+		{"last reader", false, true},
+		{"shared", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var etag atomic.Value
+			etag.Store(`"v1"`)
+			obj, content, hits := newTestObject(t, &etag, 0)
+			defer obj.Close()
+			first := obj.open(testChunk, 2*testChunk-1, 0)
+			f := first.attach(1) // 上游响应前持有下载
+			second := obj.open(testChunk, 2*testChunk-1, 0)
+			if tt.keep {
+				second.attach(1)
+			}
+			first.Close()
+			if f.download.isCanceled() != tt.canceled {
+				t.Fatalf("canceled = %v, want %v", f.download.isCanceled(), tt.canceled)
+			}
+			b, err := io.ReadAll(second)
+			second.Close()
+			if err != nil || !bytes.Equal(b, content[testChunk:2*testChunk]) {
+				t.Fatalf("second reader: %d bytes, %v", len(b), err)
+			}
+			if !tt.canceled && hits.Load() != 1 { // 仍有读取方时共用同一次下载
+				t.Fatalf("upstream requests = %d, want 1", hits.Load())
+			}
+			for deadline := time.Now().Add(5 * time.Second); !obj.store.Has([]byte("1")); time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("chunk never stored")
+				}
+			}
+		})
+	}
+}
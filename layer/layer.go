@@ -2,25 +2,33 @@ package layer
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"sync"
 
 	"github.com/suconghou/cachelayer/multio"
-	"github.com/suconghou/cachelayer/util"
 )
 
 const (
-	// ChunkSize 定义了缓存分片的细粒度大小，固定大小 256KB
+	// ChunkSize 定义了缓存分片的默认大小 256KB，vhost 未配置 chunkSize 时使用
 	ChunkSize = 256 * 1024
+	// downloadWindow 是一次回源下载最多覆盖的字节数，读取到窗口之后的分片时再发起新的下载
+	downloadWindow = 16 << 20
 )
 
+// prefetchSlots 限制所有对象合计同时进行的预取下载数
+var prefetchSlots = make(chan struct{}, 16)
+
+// SetPrefetchLimit 设置同时进行的预取下载数上限，应在开始服务前调用
+func SetPrefetchLimit(n int) {
+	prefetchSlots = make(chan struct{}, max(n, 0))
+}
+
 // getter 是执行实际HTTP请求的函数签名
 type getter func(string, http.Header) (io.ReadCloser, int, http.Header, error)
 
-// cacheLayer 实现了 io.ReadCloser 接口
+// cacheLayer 顺序读取对象的一个范围，实现了 io.ReadCloser 接口
 type cacheLayer struct {
 	target     string
 	getter     getter
@@ -28,121 +36,41 @@ type cacheLayer struct {
 	start      int64
 	end        int64
 	reqHeaders http.Header
+	meta       *ObjectMeta
 	length     int64
-	ttl        int64
+	chunkSize  int64
 
 	reader io.ReadCloser // 内部使用的拼接读取器
 	once   sync.Once     // 保证读取器只构建一次
 	err    error         // 存储构建读取器时发生的错误
-}
 
-type cacheKVItem struct {
-	load   func() (io.Reader, error)
-	reader io.Reader // 内部使用的拼接读取器
-	once   sync.Once // 保证读取器只构建一次
-	err    error     // 存储构建读取器时发生的错误
-}
+	readahead int64 // 预取的分片数
 
-func (c *cacheKVItem) Read(p []byte) (int, error) {
-	c.once.Do(func() {
-		c.reader, c.err = c.load()
-	})
-	if c.err != nil {
-		return 0, c.err
-	}
-	return c.reader.Read(p)
+	mu           sync.Mutex
+	downloads    []*download // 读取过程中持有引用的下载任务，Close 时释放
+	prefetched   *download   // 本次读取触发的预取，读完整个范围时保留，提前关闭时释放
+	read         int64       // 已返回的字节数
+	eof          bool        // 是否已读完整个范围
+	prefetchOnce sync.Once
 }
 
-// lazyDownloader 是一个下载任务的占位符，实现了 io.ReadCloser
-type lazyDownloader struct {
-	layer     *cacheLayer // 引用父级以访问 getter, storage 等
-	startByte int64
-	endByte   int64
-
-	reader io.ReadCloser // 实际的下载通道 (cachingTeeReader)
+// chunkReader 读取单个分片，首次读取时才决定是读取缓存、加入正在进行的下载，还是发起新的下载
+type chunkReader struct {
+	layer  *cacheLayer
+	index  int64
+	reader io.Reader
 	once   sync.Once
 	err    error
 }
 
-// Read 在首次被调用时，才真正触发下载
-func (l *lazyDownloader) Read(p []byte) (int, error) {
-	l.once.Do(func() {
-		headers := l.layer.reqHeaders.Clone()
-		headers.Set("Range", fmt.Sprintf("bytes=%d-%d", l.startByte, l.endByte))
-		res, _, _, err := l.layer.getter(l.layer.target, headers) // 如果statusCode非200区间，则err有值
-		if err != nil {
-			l.err = err
-			if res != nil {
-				res.Close()
-			}
-			return
-		}
-		l.reader = &cachingTeeReader{
-			source:            res,
-			store:             l.layer.store,
-			ttl:               l.layer.ttl,
-			currentChunkIndex: l.startByte / ChunkSize, // 计算起始分片索引
-			buffer:            util.BufferPool.Get(1 << 20),
-			expectedSize:      l.endByte - l.startByte + 1,
-		}
+func (r *chunkReader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		r.reader, r.err = r.layer.openChunk(r.index)
 	})
-	if l.err != nil {
-		return 0, l.err
+	if r.err != nil {
+		return 0, r.err
 	}
-	return l.reader.Read(p)
-}
-
-// Close 确保底层的 reader 被关闭
-func (l *lazyDownloader) Close() error {
-	if l.reader != nil {
-		return l.reader.Close()
-	}
-	return nil
-}
-
-// cachingTeeReader 是 "边下边存" 的智能通道，实现了 io.ReadCloser
-type cachingTeeReader struct {
-	source io.ReadCloser // 原始 HTTP 响应体
-	store  CacheStore
-	ttl    int64
-
-	currentChunkIndex int64         // 当前正在填充的分片索引
-	buffer            *bytes.Buffer // 当前分片的缓冲
-	sourceEOF         bool          // 标记底层数据流是否已结束
-	bytesRead         int64         // 已读取的字节数
-	expectedSize      int64         // 预期需要读取的总字节数
-}
-
-func (r *cachingTeeReader) Read(p []byte) (n int, err error) {
-	n, err = r.source.Read(p)
-	if n > 0 {
-		r.bytesRead += int64(n)
-		r.buffer.Write(p[:n])             // Tee: 将读到的数据也写入我们自己的缓冲
-		for r.buffer.Len() >= ChunkSize { // 检查缓冲是否达到了一个或多个分片的大小
-			chunkData := r.buffer.Next(ChunkSize) // 存储完整的分片
-			if err = r.store.Set([]byte(strconv.FormatInt(r.currentChunkIndex, 10)), chunkData, r.ttl); err != nil {
-				util.Log.Print(err)
-			}
-			r.currentChunkIndex++ // 移至下一个分片
-		}
-	}
-	if err == io.EOF || (r.expectedSize > 0 && r.bytesRead >= r.expectedSize) {
-		r.sourceEOF = true
-	}
-	return n, err
-}
-
-func (r *cachingTeeReader) Close() error {
-	// 只有当底层数据流被完全读完 (sourceEOF为true) 并且缓冲区还有剩余数据时，
-	// 才认为这是文件的最后一个、不完整的分片，并将其存入缓存。
-	if r.sourceEOF && r.buffer.Len() > 0 {
-		if err := r.store.Set([]byte(strconv.FormatInt(r.currentChunkIndex, 10)), r.buffer.Bytes(), r.ttl); err != nil {
-			util.Log.Print(err)
-		}
-	}
-	r.buffer.Reset()
-	util.BufferPool.Put(r.buffer)
-	return r.source.Close()
+	return r.reader.Read(p)
 }
 
 func (c *cacheLayer) Read(p []byte) (int, error) {
@@ -152,55 +80,48 @@ func (c *cacheLayer) Read(p []byte) (int, error) {
 	if c.err != nil {
 		return 0, c.err
 	}
-	return c.reader.Read(p)
+	n, err := c.reader.Read(p)
+	// 按已返回的字节数判断是否读完，http.ServeContent 用 io.CopyN 只读取范围内的字节数，不会读到 io.EOF
+	c.mu.Lock()
+	c.read += int64(n)
+	if c.read >= c.end-c.start+1 {
+		c.eof = true
+	}
+	c.mu.Unlock()
+	return n, err
 }
 
+// Close 释放持有的下载，没有读完整个范围时（客户端中断或跳转）同时取消无人使用的预取
 func (c *cacheLayer) Close() error {
+	var err error
 	if c.reader != nil {
-		return c.reader.Close()
+		err = c.reader.Close()
+	}
+	c.mu.Lock()
+	downloads := c.downloads
+	c.downloads = nil
+	if c.prefetched != nil && !c.eof {
+		downloads = append(downloads, c.prefetched)
 	}
-	return nil
+	c.prefetched = nil
+	c.mu.Unlock()
+	for _, d := range downloads {
+		d.release()
+	}
+	return err
 }
 
 func (c *cacheLayer) buildReader() (io.ReadCloser, error) {
 	var (
 		readers    []io.Reader
-		startChunk = c.start / ChunkSize
-		endChunk   = c.end / ChunkSize
+		startChunk = c.start / c.chunkSize
+		endChunk   = c.end / c.chunkSize
 	)
-	for i := startChunk; i <= endChunk; { // 遍历所有需要的分片
-		chunkKey := []byte(strconv.FormatInt(i, 10))
-		if c.store.Has(chunkKey, c.ttl) {
-			readers = append(readers, &cacheKVItem{load: func() (io.Reader, error) {
-				b, err := c.store.Get(chunkKey)
-				return bytes.NewReader(b), err
-			}})
-			i++
-		} else {
-			missingEndChunk := i
-			for j := i + 1; j <= endChunk; j++ {
-				chunkKey = []byte(strconv.FormatInt(j, 10))
-				if c.store.Has(chunkKey, c.ttl) {
-					break
-				}
-				missingEndChunk = j
-			}
-			downloadStart := i * ChunkSize
-			downloadEnd := (missingEndChunk+1)*ChunkSize - 1
-			if downloadEnd >= c.length {
-				downloadEnd = c.length - 1
-			}
-			downloader := &lazyDownloader{
-				layer:     c, // 传递对 cacheLayer 的引用
-				startByte: downloadStart,
-				endByte:   downloadEnd,
-			}
-			readers = append(readers, downloader)
-			i = missingEndChunk + 1 // 跳过整个缺失的区块
-		}
+	for i := startChunk; i <= endChunk; i++ { // 每个分片都延迟到读取时再确定数据来源
+		readers = append(readers, &chunkReader{layer: c, index: i})
 	}
 	multiReader := multio.MultiReadReader(readers...)
-	startOffsetInChunk := c.start - (startChunk * ChunkSize)
+	startOffsetInChunk := c.start - (startChunk * c.chunkSize)
 	if startOffsetInChunk > 0 {
 		if _, err := io.CopyN(io.Discard, multiReader, startOffsetInChunk); err != nil {
 			return nil, err
@@ -211,17 +132,139 @@ func (c *cacheLayer) buildReader() (io.ReadCloser, error) {
 	return multio.FuncCloser(finalReader, multiReader.Close), nil
 }
 
-// 传入的getter在非200区间时也自动抛出错误, 传入的start,end必须先修正/校验正确，start<=end , end < length ，end是0时置为length-1
-func NewCacheLayer(gt getter, target string, cstore CacheStore, start, end int64, reqHeaders http.Header, length, ttl int64) io.ReadCloser {
-	l := &cacheLayer{
+func (c *cacheLayer) openChunk(index int64) (io.Reader, error) {
+	if c.readahead > 0 && index+c.readahead > c.end/c.chunkSize {
+		c.prefetchOnce.Do(c.prefetch)
+	}
+	chunkKey := []byte(strconv.FormatInt(index, 10))
+	if c.store.Has(chunkKey) {
+		b, err := c.store.Get(chunkKey)
+		if err != nil {
+			return nil, err
+		}
+		if b != nil { // 刚好被淘汰或过期时继续走下载流程
+			return bytes.NewReader(b), nil
+		}
+	}
+	return &flightReader{flight: c.attach(index)}, nil
+}
+
+// attach 返回分片对应的下载中的分片，如果没有正在进行的下载，则从该分片开始发起新的下载，
+// 下载范围向后延伸到第一个已缓存或正在下载的分片为止，其他读取方读到这些分片时直接共享这次下载
+func (c *cacheLayer) attach(index int64) *flight {
+	d, f := c.newDownload(index, c.end/c.chunkSize, true)
+	if d == nil {
+		c.hold(f.download)
+		return f
+	}
+	c.hold(d)
+	go d.run()
+	return f
+}
+
+// cached 检查分片是否已缓存或正在下载
+func (c *cacheLayer) cached(index int64) bool {
+	flightsMu.Lock()
+	f, ok := flights[flightKey(c.store.Key(), index)]
+	flightsMu.Unlock()
+	if ok && !f.download.isCanceled() {
+		return true
+	}
+	return c.store.Has([]byte(strconv.FormatInt(index, 10)))
+}
+
+// newDownload 创建覆盖 [index, last] 的下载任务并登记各个分片，调用方持有一个引用
+// 遇到已缓存或正在下载的分片时提前结束，一次最多覆盖 downloadWindow 字节，index 所在分片总是包含在内
+// index 所在分片已在下载时不创建新的下载，join 为 true 时加入该下载并返回该分片，否则两个返回值都为 nil；
+// 检查与登记在同一次加锁中完成，同一分片并发未命中时只会回源一次
+func (c *cacheLayer) newDownload(index, last int64, join bool) (*download, *flight) {
+	var end = index
+	last = min(last, index+max(downloadWindow/c.chunkSize, 1)-1)
+	for j := index + 1; j <= last && !c.cached(j); j++ {
+		end = j
+	}
+	flightsMu.Lock()
+	defer flightsMu.Unlock()
+	if f, ok := flights[flightKey(c.store.Key(), index)]; ok && !f.download.isCanceled() {
+		if join && f.download.acquire() {
+			return nil, f
+		}
+		if !join {
+			return nil, nil
+		}
+	}
+	d := &download{
+		getter:     c.getter,
+		target:     c.target,
+		store:      c.store,
+		reqHeaders: c.reqHeaders,
+		meta:       c.meta,
+		refs:       1,
+	}
+	for j := index; j <= end; j++ {
+		key := flightKey(c.store.Key(), j)
+		if f, ok := flights[key]; ok && j > index && !f.download.isCanceled() {
+			break
+		}
+		f := &flight{download: d, index: j, key: key}
+		f.cond = sync.NewCond(&f.mu)
+		flights[key] = f
+		d.flights = append(d.flights, f)
+	}
+	return d, d.flights[0]
+}
+
+// prefetch 在读取进入范围末尾的 readahead 个分片时，后台预取范围之后的 readahead 个分片
+// 已缓存或正在下载的分片会被跳过，总并发数超过限制时放弃本次预取
+func (c *cacheLayer) prefetch() {
+	var (
+		first = c.end/c.chunkSize + 1
+		last  = min(c.end/c.chunkSize+c.readahead, (c.length-1)/c.chunkSize)
+	)
+	for first <= last && c.cached(first) {
+		first++
+	}
+	if first > last {
+		return
+	}
+	select {
+	case prefetchSlots <- struct{}{}:
+	default:
+		return
+	}
+	d, _ := c.newDownload(first, last, false)
+	if d == nil { // 已被其他读取方开始下载
+		<-prefetchSlots
+		return
+	}
+	c.mu.Lock()
+	c.prefetched = d
+	c.mu.Unlock()
+	go func() {
+		d.run()
+		<-prefetchSlots
+	}()
+}
+
+// hold 记录已持有引用的下载任务，在 Close 时统一释放
+func (c *cacheLayer) hold(d *download) {
+	c.mu.Lock()
+	c.downloads = append(c.downloads, d)
+	c.mu.Unlock()
+}
+
+// newCacheLayer 返回读取 [start, end] 的读取器，传入的getter在非200区间时也自动抛出错误，start、end 必须先修正/校验正确，start<=end , end < length
+func newCacheLayer(gt getter, target string, cstore CacheStore, start, end int64, reqHeaders http.Header, meta *ObjectMeta, readahead int64) *cacheLayer {
+	return &cacheLayer{
 		getter:     gt,
 		target:     target,
 		store:      cstore,
 		start:      start,
 		end:        end,
 		reqHeaders: reqHeaders,
-		length:     length,
-		ttl:        ttl,
+		meta:       meta,
+		length:     meta.Length,
+		chunkSize:  meta.ChunkSize,
+		readahead:  readahead,
 	}
-	return l
 }
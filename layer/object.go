@@ -0,0 +1,156 @@
+package layer
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/suconghou/cachelayer/util"
+)
+
+var (
+	errWhence = errors.New("Seek: invalid whence")
+	errOffset = errors.New("Seek: invalid offset")
+)
+
+// Object 把一个缓存对象表示为 io.ReadSeeker 与 io.ReaderAt，可以直接交给 http.ServeContent
+// 只有读取时才按分片决定读取缓存、加入正在进行的下载还是回源下载，Seek 本身不读取任何分片
+type Object struct {
+	getter     getter
+	target     string
+	store      CacheStore
+	reqHeaders http.Header
+	meta       *ObjectMeta
+	readahead  int64
+
+	mu     sync.Mutex
+	ranges []util.Range // 预计读取的范围
+	offset int64
+	layer  *cacheLayer // 从 offset 开始顺序读取的读取器，Seek 到其他位置时关闭
+}
+
+// NewObject 返回缓存对象，传入的getter在非200区间时也自动抛出错误，readahead 为顺序读取到范围末尾时预取的分片数
+func NewObject(gt getter, target string, cstore CacheStore, reqHeaders http.Header, meta *ObjectMeta, readahead int64) *Object {
+	return &Object{
+		getter:     gt,
+		target:     target,
+		store:      cstore,
+		reqHeaders: reqHeaders,
+		meta:       meta,
+		readahead:  readahead,
+	}
+}
+
+// Size 返回对象大小
+func (o *Object) Size() int64 {
+	return o.meta.Length
+}
+
+// SetRanges 设置预计读取的范围，顺序读取时回源下载及预取以所在范围的末尾为界，不在任何范围内时以对象末尾为界
+func (o *Object) SetRanges(ranges []util.Range) {
+	o.mu.Lock()
+	o.ranges = ranges
+	o.mu.Unlock()
+}
+
+func (o *Object) Read(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for {
+		if o.offset >= o.meta.Length {
+			return 0, io.EOF
+		}
+		if o.layer == nil {
+			o.layer = o.open(o.offset, o.rangeEnd(o.offset), o.readahead)
+		}
+		n, err := o.layer.Read(p)
+		o.offset += int64(n)
+		if err == io.EOF { // 读完所在范围，之后的读取从新的位置重新打开
+			end := o.layer.end
+			err = o.layer.Close()
+			o.layer = nil
+			if err == nil && o.offset <= end { // 缓存的分片比预期短，没有读到范围末尾，不能在原位置无限重试
+				err = io.ErrUnexpectedEOF
+			}
+			if n == 0 && err == nil {
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+func (o *Object) Seek(offset int64, whence int) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.meta.Length
+	default:
+		return 0, errWhence
+	}
+	if offset < 0 {
+		return 0, errOffset
+	}
+	if offset != o.offset && o.layer != nil {
+		o.layer.Close()
+		o.layer = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+// ReadAt 读取 [off, off+len(p)) 范围内的数据，只回源下载这个范围内缺失的分片，可以并发调用
+func (o *Object) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errOffset
+	}
+	if off >= o.meta.Length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var (
+		end = min(off+int64(len(p)), o.meta.Length) - 1
+		l   = o.open(off, end, 0)
+	)
+	n, err := io.ReadFull(l, p[:end-off+1])
+	if e := l.Close(); err == nil {
+		err = e
+	}
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close 关闭顺序读取的读取器，释放持有的下载
+func (o *Object) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.layer == nil {
+		return nil
+	}
+	err := o.layer.Close()
+	o.layer = nil
+	return err
+}
+
+func (o *Object) open(start, end, readahead int64) *cacheLayer {
+	return newCacheLayer(o.getter, o.target, o.store, start, end, o.reqHeaders, o.meta, readahead)
+}
+
+// rangeEnd 返回 offset 所在的预计读取范围的末尾
+func (o *Object) rangeEnd(offset int64) int64 {
+	for _, r := range o.ranges {
+		if offset >= r.Start && offset <= r.End {
+			return r.End
+		}
+	}
+	return o.meta.Length - 1
+}
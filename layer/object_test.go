@@ -0,0 +1,239 @@
+package layer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/suconghou/cachelayer/store"
+	"github.com/suconghou/cachelayer/util"
+)
+
+const testChunk = 1024
+
+// newTestObject 返回以 httptest 为上游的缓存对象，对象大小为 3.5 个分片，hits 记录回源次数
+// 上游返回首个分片之后的范围时稍慢，回源未完成时关闭读取器会取消下载
+func newTestObject(t *testing.T, etag *atomic.Value, readahead int64) (*Object, []byte, *atomic.Int64) {
+	var (
+		content = make([]byte, testChunk*7/2)
+		hits    = new(atomic.Int64)
+	)
+	rand.New(rand.NewSource(1)).Read(content)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if !strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Header().Set("ETag", etag.Load().(string))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	backend, err := store.Open("mem", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gt := func(target string, h http.Header) (io.ReadCloser, int, http.Header, error) {
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		req.Header = h
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if resp.StatusCode/100 != 2 {
+			resp.Body.Close()
+			return nil, resp.StatusCode, resp.Header, errors.New(resp.Status)
+		}
+		return resp.Body, resp.StatusCode, resp.Header, nil
+	}
+	var h = http.Header{}
+	h.Set("ETag", etag.Load().(string))
+	meta := NewObjectMeta(int64(len(content)), testChunk, h, nil, 0)
+	cstore := NewCacheStore(backend, []byte(t.Name()))
+	if err = cstore.SetMeta(meta, 0); err != nil {
+		t.Fatal(err)
+	}
+	return NewObject(gt, srv.URL, cstore, http.Header{}, meta, readahead), content, hits
+}
+
+func TestObjectReadAt(t *testing.T) {
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	obj, content, hits := newTestObject(t, &etag, 0)
+	defer obj.Close()
+	var size = int64(len(content))
+	var tests = []struct {
+		name string
+		off  int64
+		n    int
+		want int
+		err  error
+	}{
+		{"first byte", 0, 1, 1, nil},
+		{"inside a chunk", 10, 100, 100, nil},
+		{"across chunks", testChunk - 10, testChunk + 20, testChunk + 20, nil},
+		{"last partial chunk", size - 100, 100, 100, nil},
+		{"beyond end", size - 10, 100, 10, io.EOF},
+		{"at end", size, 10, 0, io.EOF},
+		{"empty", 5, 0, 0, nil},
+		{"negative", -1, 10, 0, errOffset},
+	}
+	for _, tt := range tests {
+		var p = make([]byte, tt.n)
+		n, err := obj.ReadAt(p, tt.off)
+		if n != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("%s: ReadAt(%d bytes at %d) = %d, %v, want %d, %v", tt.name, tt.n, tt.off, n, err, tt.want, tt.err)
+			continue
+		}
+		if n > 0 && !bytes.Equal(p[:n], content[tt.off:tt.off+int64(n)]) {
+			t.Errorf("%s: ReadAt(%d bytes at %d) returned wrong content", tt.name, tt.n, tt.off)
+		}
+	}
+	var h = hits.Load()
+	var p = make([]byte, size)
+	if n, err := obj.ReadAt(p, 0); n != len(p) || err != nil || !bytes.Equal(p, content) {
+		t.Fatalf("ReadAt whole object = %d, %v", n, err)
+	}
+	if n := hits.Load() - h; n != 0 { // 之前的读取已经覆盖了全部分片
+		t.Fatalf("cached chunks fetched again: %d origin requests", n)
+	}
+}
+
+func TestObjectSeek(t *testing.T) {
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	obj, content, hits := newTestObject(t, &etag, 0)
+	defer obj.Close()
+	var size = int64(len(content))
+	var tests = []struct {
+		name   string
+		offset int64
+		whence int
+		pos    int64
+		n      int
+	}{
+		{"start", 0, io.SeekStart, 0, 100},
+		{"current", 100, io.SeekCurrent, 200, 100},
+		{"backwards", -50, io.SeekCurrent, 250, testChunk},
+		{"from end", -10, io.SeekEnd, size - 10, 10},
+		{"middle chunk", 2 * testChunk, io.SeekStart, 2 * testChunk, testChunk},
+	}
+	for _, tt := range tests {
+		pos, err := obj.Seek(tt.offset, tt.whence)
+		if err != nil || pos != tt.pos {
+			t.Fatalf("%s: Seek(%d, %d) = %d, %v, want %d", tt.name, tt.offset, tt.whence, pos, err, tt.pos)
+		}
+		var p = make([]byte, tt.n)
+		if _, err = io.ReadFull(obj, p); err != nil {
+			t.Fatalf("%s: read %d bytes at %d: %v", tt.name, tt.n, pos, err)
+		}
+		if !bytes.Equal(p, content[pos:pos+int64(tt.n)]) {
+			t.Fatalf("%s: wrong content at %d", tt.name, pos)
+		}
+	}
+	if _, err := obj.Seek(-1, io.SeekStart); !errors.Is(err, errOffset) {
+		t.Fatalf("Seek(-1) error = %v", err)
+	}
+	if _, err := obj.Seek(0, 3); !errors.Is(err, errWhence) {
+		t.Fatalf("Seek whence 3 error = %v", err)
+	}
+	if _, err := obj.Seek(size, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := obj.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Fatalf("Read at end = %d, %v", n, err)
+	}
+	if _, err := obj.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(obj)
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("ReadAll = %d bytes, %v", len(b), err)
+	}
+	var h = hits.Load()
+	if _, err = obj.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = io.ReadAll(obj); err != nil || !bytes.Equal(b, content) || hits.Load() != h {
+		t.Fatalf("second ReadAll = %d bytes, %v, %d origin requests", len(b), err, hits.Load()-h)
+	}
+}
+
+func TestObjectChanged(t *testing.T) {
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	obj, _, _ := newTestObject(t, &etag, 0)
+	defer obj.Close()
+	etag.Store(`"v2"`)
+	if _, err := obj.ReadAt(make([]byte, 10), testChunk); !errors.Is(err, errChanged) {
+		t.Fatalf("ReadAt after upstream change error = %v, want %v", err, errChanged)
+	}
+}
+
+func TestObjectShortChunk(t *testing.T) {
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	obj, content, _ := newTestObject(t, &etag, 0)
+	if err := obj.store.Set([]byte("3"), content[3*testChunk:len(content)-10]); err != nil {
+		t.Fatal(err)
+	}
+	var done = make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(obj)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("ReadAll with a short chunk error = %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+		obj.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadAll with a short chunk never returns")
+	}
+}
+
+func TestObjectServeContentPrefetch(t *testing.T) {
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	obj, content, _ := newTestObject(t, &etag, 2)
+	var tests = []struct {
+		name   string
+		header string
+		ranges []util.Range
+		want   []byte
+	}{
+		{"first chunk", "bytes=0-1023", []util.Range{{Start: 0, End: testChunk - 1}}, content[:testChunk]},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Range", tt.header)
+		rec := httptest.NewRecorder()
+		obj.SetRanges(tt.ranges)
+		http.ServeContent(rec, req, "", time.Time{}, obj)
+		if err := obj.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), tt.want) {
+			t.Fatalf("%s: ServeContent = %d, %d bytes", tt.name, rec.Code, rec.Body.Len())
+		}
+	}
+	// 范围由 io.CopyN 读完，不会读到 io.EOF，预取的分片仍应写入缓存
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if obj.store.Has([]byte("1")) && obj.store.Has([]byte("2")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("prefetched chunks were not stored")
+		}
+	}
+}
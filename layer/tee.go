@@ -0,0 +1,117 @@
+package layer
+
+import (
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/suconghou/cachelayer/store"
+	"github.com/suconghou/cachelayer/util"
+)
+
+// objectTee 在把上游不支持range的完整响应转发给客户端的同时，按分片写入缓存
+// 响应体完整读完后才写入元信息，中途出错或客户端提前关闭时删除已写入的分片
+type objectTee struct {
+	reader    io.ReadCloser
+	store     CacheStore
+	chunkSize int64
+	length    int64 // 响应头中的 Content-Length，未知时为 -1
+	save      func(int64) error
+	done      func()
+	buf       []byte
+	index     int64
+	total     int64
+	finished  bool
+	failed    bool
+}
+
+// NewObjectTee 返回边读边缓存整个对象的读取器，length 未知时传 -1
+// 全部分片写入后以对象大小调用 save 写入元信息，Close 时调用 done
+func NewObjectTee(r io.ReadCloser, cstore CacheStore, chunkSize, length int64, save func(int64) error, done func()) io.ReadCloser {
+	return &objectTee{
+		reader:    r,
+		store:     cstore,
+		chunkSize: chunkSize,
+		length:    length,
+		save:      save,
+		done:      done,
+		buf:       make([]byte, 0, chunkSize),
+	}
+}
+
+func (t *objectTee) Read(p []byte) (int, error) {
+	n, err := t.reader.Read(p)
+	if !t.finished && !t.failed {
+		t.write(p[:n])
+		if err == io.EOF {
+			t.finish()
+		} else if err != nil {
+			t.fail(err)
+		}
+	}
+	return n, err
+}
+
+// write 追加数据，每凑满一个分片就写入缓存
+func (t *objectTee) write(p []byte) {
+	t.total += int64(len(p))
+	for len(p) > 0 {
+		n := min(len(p), cap(t.buf)-len(t.buf))
+		t.buf = append(t.buf, p[:n]...)
+		p = p[n:]
+		if len(t.buf) == cap(t.buf) && !t.flush() {
+			return
+		}
+	}
+}
+
+func (t *objectTee) flush() bool {
+	if err := t.store.Set([]byte(strconv.FormatInt(t.index, 10)), t.buf); err != nil {
+		t.fail(err)
+		return false
+	}
+	t.index++
+	t.buf = t.buf[:0]
+	return true
+}
+
+func (t *objectTee) finish() {
+	if t.length >= 0 && t.total != t.length {
+		t.fail(io.ErrUnexpectedEOF)
+		return
+	}
+	if t.total == 0 { // 空对象无需缓存
+		t.finished = true
+		return
+	}
+	if len(t.buf) > 0 && !t.flush() {
+		return
+	}
+	if err := t.save(t.total); err != nil {
+		t.fail(err)
+		return
+	}
+	t.finished = true
+}
+
+// fail 放弃缓存，删除已写入的分片，写入队列已满丢弃了分片时同样放弃
+func (t *objectTee) fail(err error) {
+	t.failed = true
+	if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, store.ErrQueueFull) {
+		util.Log.Print(err)
+	}
+	if t.index > 0 {
+		if err := t.store.Remove(); err != nil {
+			util.Log.Print(err)
+		}
+	}
+}
+
+func (t *objectTee) Close() error {
+	if !t.finished && !t.failed {
+		t.fail(io.ErrUnexpectedEOF)
+	}
+	err := t.reader.Close()
+	t.done()
+	return err
+}
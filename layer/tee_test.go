@@ -0,0 +1,88 @@
+package layer
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+	"testing/iotest"
+
+	"github.com/suconghou/cachelayer/store"
+)
+
+func TestObjectTee(t *testing.T) {
+	var content = bytes.Repeat([]byte("0123456789abcdef"), testChunk*5/2/16) // 2.5 个分片
+	var tests = []struct {
+		name    string
+		body    []byte
+		length  int64
+		read    int64 // 读取的字节数，-1 表示读到 EOF
+		queue   int64 // 写入队列的容量，0 表示不使用队列
+		saved   int64 // 写入元信息时的对象大小，-1 表示未写入
+		chunks  int   // 缓存中的分片数
+		readErr bool
+	}{
+		{"known length", content, int64(len(content)), -1, 0, int64(len(content)), 3, false},
+		{"unknown length", content, -1, -1, 0, int64(len(content)), 3, false},
+		{"whole chunks", content[:2*testChunk], -1, -1, 0, 2 * testChunk, 2, false},
+		{"short body", content[:2*testChunk], int64(len(content)), -1, 0, -1, 0, true},
+		{"closed early", content, int64(len(content)), testChunk + 10, 0, -1, 0, false},
+		{"empty", nil, 0, -1, 0, -1, 0, false},
+		{"queue full", content, int64(len(content)), -1, 1, -1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, err := store.Open("mem", "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backend = store.WriteBehind(backend, tt.queue)
+			var (
+				cstore = NewCacheStore(backend, []byte("tee"))
+				saved  = int64(-1)
+				done   bool
+				body   io.Reader = bytes.NewReader(tt.body)
+			)
+			if tt.length > int64(len(tt.body)) { // 模拟连接中断，响应体比 Content-Length 短
+				body = io.MultiReader(body, iotest.ErrReader(io.ErrUnexpectedEOF))
+			}
+			save := func(total int64) error {
+				saved = total
+				return cstore.SetMeta(NewObjectMeta(total, testChunk, nil, nil, 0), 0)
+			}
+			tee := NewObjectTee(io.NopCloser(body), cstore, testChunk, tt.length, save, func() { done = true })
+			var got []byte
+			if tt.read < 0 {
+				got, err = io.ReadAll(tee)
+			} else {
+				got, err = io.ReadAll(io.LimitReader(tee, tt.read))
+			}
+			if (err != nil) != tt.readErr {
+				t.Fatalf("read error = %v", err)
+			}
+			if tt.read < 0 && !bytes.Equal(got, tt.body) { // 转发给客户端的内容不受缓存影响
+				t.Fatalf("forwarded %d bytes, want %d", len(got), len(tt.body))
+			}
+			if err = tee.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !done {
+				t.Fatal("done not called")
+			}
+			if saved != tt.saved {
+				t.Fatalf("saved = %d, want %d", saved, tt.saved)
+			}
+			var chunks int
+			for i := 0; cstore.Has([]byte(strconv.Itoa(i))); i++ {
+				b, _ := cstore.Get([]byte(strconv.Itoa(i)))
+				if !bytes.Equal(b, content[i*testChunk:min((i+1)*testChunk, len(tt.body))]) {
+					t.Fatalf("chunk %d mismatch", i)
+				}
+				chunks++
+			}
+			if chunks != tt.chunks {
+				t.Fatalf("cached chunks = %d, want %d", chunks, tt.chunks)
+			}
+		})
+	}
+}
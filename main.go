@@ -11,6 +11,8 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/suconghou/cachelayer/layer"
+	"github.com/suconghou/cachelayer/request"
 	"github.com/suconghou/cachelayer/route"
 	"github.com/suconghou/cachelayer/store"
 	"github.com/suconghou/cachelayer/util"
@@ -22,13 +24,29 @@ func main() {
 		port  = flag.Int("p", 6060, "listen port")
 		host  = flag.String("h", "", "bind address")
 		cfile = flag.String("c", "vhost.json", "config file path")
-		cache = flag.String("f", "cache.db", "cache file")
+		cache = flag.String("f", "cache.db", "cache file, or cache directory for fs store")
+		max   = flag.String("max-size", "0", "max cache size, e.g. 200G, 0 means unlimited")
+		back  = flag.String("s", "bolt", fmt.Sprintf("store backend %v", store.Backends()))
+		queue = flag.String("q", "64M", "write-behind queue size in bytes, e.g. 64M, 0 means write synchronously")
+		pf    = flag.Int("prefetch", 16, "max concurrent read-ahead downloads, 0 disables read-ahead")
 	)
 	flag.Parse()
-	if err := store.Init(*cache); err != nil {
+	maxSize, err := util.ParseSize(*max)
+	if err != nil {
 		util.Log.Fatal(err)
 	}
-	go signalListen(*cfile)
+	backend, err := store.Open(*back, *cache, maxSize)
+	if err != nil {
+		util.Log.Fatal(err)
+	}
+	queueSize, err := util.ParseSize(*queue)
+	if err != nil {
+		util.Log.Fatal(err)
+	}
+	backend = store.WriteBehind(backend, queueSize)
+	layer.SetPrefetchLimit(*pf)
+	request.Init(backend)
+	go signalListen(*cfile, backend)
 	util.Log.Fatal(serve(*host, *port))
 }
 
@@ -75,7 +93,7 @@ func tryFiles(files []string, w http.ResponseWriter, r *http.Request) bool {
 	return false
 }
 
-func signalListen(cfile string) {
+func signalListen(cfile string, backend store.Backend) {
 	tick := time.NewTicker(time.Minute * 5)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
@@ -83,12 +101,12 @@ func signalListen(cfile string) {
 	for {
 		select {
 		case <-tick.C:
-			if err := store.Expire(); err != nil {
+			if err := backend.Expire(); err != nil {
 				util.Log.Print(err)
 			}
 		case s := <-c:
 			if s == syscall.SIGUSR2 {
-				if err := store.Expire(); err != nil {
+				if err := backend.Expire(); err != nil {
 					util.Log.Print(err)
 				}
 			} else {
@@ -33,7 +33,8 @@ func (mc *multiReadCloser) Read(p []byte) (n int, err error) {
 			return
 		}
 		if err == io.EOF {
-			// 当前 reader 已读完，移至下一个
+			// 当前 reader 已读完，移至下一个，并释放对它的引用
+			mc.readers[0] = nil
 			mc.readers = mc.readers[1:]
 		} else if err != nil {
 			return n, err // 立即返回非 EOF 错误
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/suconghou/cachelayer/util"
+	"github.com/suconghou/cachelayer/vhost"
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(io.Discard) },
+}
+
+// compressWriter 在写入响应头时按 compress 决定是否压缩响应体，写完后需要 Close
+type compressWriter struct {
+	http.ResponseWriter
+	accept      string
+	v           *vhost.Vhost
+	wroteHeader bool
+	gzip        bool
+	gz          *gzip.Writer
+}
+
+func (c *compressWriter) WriteHeader(statusCode int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	c.gzip = compress(c.Header(), c.accept, statusCode, c.v)
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.gzip {
+		return c.ResponseWriter.Write(p)
+	}
+	if c.gz == nil { // 第一次写入响应体时才创建，HEAD 请求不会写入
+		c.gz = gzipWriters.Get().(*gzip.Writer)
+		c.gz.Reset(c.ResponseWriter)
+	}
+	return c.gz.Write(p)
+}
+
+// Close 写入压缩数据的结尾，并把压缩器放回池中
+func (c *compressWriter) Close() error {
+	if c.gz == nil {
+		return nil
+	}
+	err := c.gz.Close()
+	c.gz.Reset(io.Discard)
+	gzipWriters.Put(c.gz)
+	c.gz = nil
+	return err
+}
+
+// compress 按 vhost 的压缩规则及客户端 Accept-Encoding 决定是否压缩完整(200)响应，需要压缩时修改响应头并返回 true
+// 只压缩未编码的内容，range 响应的字节范围对应原始内容，不压缩
+func compress(h http.Header, accept string, statusCode int, v *vhost.Vhost) bool {
+	if statusCode != http.StatusOK || h.Get("Content-Encoding") != "" {
+		return false
+	}
+	length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil {
+		length = -1
+	}
+	if !v.Compressible(h.Get("Content-Type"), length) {
+		return false
+	}
+	if vary := util.Vary(h); !slices.Contains(vary, "Accept-Encoding") && !slices.Contains(vary, "*") {
+		h.Set("Vary", strings.Join(append(vary, "Accept-Encoding"), ", "))
+	}
+	if !acceptGzip(accept) {
+		return false
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") { // 压缩后的内容与原始内容字节不同，只能是弱校验
+		h.Set("Etag", "W/"+etag)
+	}
+	return true
+}
+
+// acceptGzip 检查客户端的 Accept-Encoding 是否接受 gzip，q=0 表示不接受
+func acceptGzip(accept string) bool {
+	var gz, all = -1, -1
+	for _, item := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		var ok = 1
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+				ok = 0
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip", "x-gzip":
+			gz = ok
+		case "*":
+			all = ok
+		}
+	}
+	if gz >= 0 {
+		return gz == 1
+	}
+	return all == 1
+}
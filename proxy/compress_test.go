@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcceptGzip(t *testing.T) {
+	var tests = []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"x-gzip", true},
+		{"deflate, gzip;q=1.0, br", true},
+		{"br, deflate", false},
+		{"identity", false},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"gzip;q=0.5", true},
+		{"*", true},
+		{"*;q=0", false},
+		{"*;q=0, gzip", true},
+		{"gzip;q=0, *", false},
+		{"identity, *;q=0", false},
+	}
+	for _, tt := range tests {
+		if got := acceptGzip(tt.accept); got != tt.want {
+			t.Errorf("acceptGzip(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamAcceptEncoding(t *testing.T) {
+	var tests = []struct {
+		name         string
+		cacheControl string
+		want         []string // 上游依次收到的 Accept-Encoding
+	}{
+		{"cached", "max-age=100", []string{"identity"}},
+		// 首次探测请求未编码的内容，不可缓存时按客户端的请求重新回源，之后的请求直接回源
+		{"no-store", "no-store", []string{"identity", "gzip, br", "gzip, br"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu      sync.Mutex
+				got     []string
+				content = strings.Repeat("cachelayer ", 100)
+			)
+			srv := newTestProxy(t, "", func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				got = append(got, r.Header.Get("Accept-Encoding"))
+				mu.Unlock()
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				http.ServeContent(w, r, "a.txt", time.Time{}, strings.NewReader(content))
+			})
+			for range 2 {
+				res, b := fetch(t, http.MethodGet, srv.URL+"/v/a.txt", http.Header{"Accept-Encoding": {"gzip, br"}})
+				if res.StatusCode != http.StatusOK || string(b) != content {
+					t.Fatalf("status %d, body %q", res.StatusCode, b)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("upstream Accept-Encoding = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package proxy
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 
+	"github.com/suconghou/cachelayer/layer"
 	"github.com/suconghou/cachelayer/request"
+	"github.com/suconghou/cachelayer/util"
 	"github.com/suconghou/cachelayer/vhost"
 )
 
@@ -14,15 +18,26 @@ var (
 		"Content-Length",
 		"Content-Type",
 		"Content-Encoding",
+		"Content-Disposition",
 		"Content-Range",
 		"Cache-Control",
 		"Last-Modified",
 		"Etag",
+		"Vary",
+		"Warning",
+		"Cache-Status",
+	}
+	// 304/412 响应只返回这些头
+	notModifiedHeaders = []string{
+		"Cache-Control",
+		"Etag",
+		"Last-Modified",
+		"Expires",
+		"Vary",
 	}
 	fwdHeadersBasic = []string{
 		"User-Agent",
 		"Accept",
-		"Accept-Encoding",
 		"Accept-Language",
 		"Cookie",
 		"Range",
@@ -32,32 +47,95 @@ var (
 )
 
 func Do(w http.ResponseWriter, r *http.Request, match []string) error {
-	url, withQuery, strictCache, client, cacheSec := vhost.Parse(match[0])
+	url, v := vhost.Parse(match[0])
 	if url == "" {
 		http.NotFound(w, r)
 		return nil
 	}
-	if !strictCache && (r.Header.Get("If-Modified-Since") != "" || r.Header.Get("If-None-Match") != "") {
-		http.Error(w, "", http.StatusNotModified)
-		return nil
-	}
-	if withQuery && r.URL.RawQuery != "" {
+	if v.WithQuery && r.URL.RawQuery != "" {
 		url = url + "?" + r.URL.RawQuery
 	}
-	var reqHeaders = copyHeader(r.Header, http.Header{}, fwdHeadersBasic)
-	res, statusCode, headers, err := request.HttpProvider.Get(url, reqHeaders, client, int64(cacheSec))
+	var (
+		key        = v.Key(url, r.Header, r.Host)
+		reqHeaders = copyHeader(r.Header, http.Header{}, fwdHeadersBasic)
+		accept     = r.Header.Get("Accept-Encoding")
+	)
+	// 填充缓存时回源始终请求未编码的内容，分片是原始内容的字节范围，与由哪个客户端填充无关，是否压缩由 compress 按客户端决定；
+	// 客户端的 Accept-Encoding 只用于不缓存、直接转发的回源请求
+	if accept != "" {
+		reqHeaders.Set("Accept-Encoding", accept)
+	}
+	if cond := copyHeader(r.Header, http.Header{}, request.CondHeaders); v.StrictCache && len(cond) > 0 { // 条件请求交给上游求值
+		statusCode, headers, err := request.HttpProvider.Check(url, reqHeaders, cond, v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+		if statusCode != 0 {
+			copyHeader(headers, w.Header(), notModifiedHeaders)
+			w.WriteHeader(statusCode)
+			return nil
+		}
+		for _, k := range request.CondHeaders { // 上游已求值，不再根据缓存的校验信息求值
+			r.Header.Del(k)
+		}
+	}
+	obj, res, statusCode, headers, err := request.HttpProvider.Open(r.Method, url, key, reqHeaders, v)
 	if res != nil {
 		defer res.Close()
 	}
+	if obj != nil {
+		defer obj.Close()
+		return serve(w, r, obj, headers, accept, v)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return err
+		if res == nil || statusCode == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+		// 上游返回的错误状态码及响应体原样转发，不再统一为 500
+		copyHeader(headers, w.Header(), exposeHeaders)
+		w.WriteHeader(statusCode)
+		if r.Method == http.MethodHead {
+			return err
+		}
+		_, e := io.Copy(w, res)
+		return errors.Join(err, e)
+	}
+	to := w.Header()
+	copyHeader(headers, to, exposeHeaders)
+	copyHeader(headers, to, v.Headers) // vhost 配置保存的响应头也一并返回
+	cw := &compressWriter{ResponseWriter: w, accept: accept, v: v}
+	cw.WriteHeader(statusCode)
+	if r.Method != http.MethodHead {
+		_, err = io.Copy(cw, res)
 	}
+	return errors.Join(err, cw.Close())
+}
+
+// serve 由 http.ServeContent 根据缓存对象响应，Range、条件请求、416 及 HEAD 都由其处理
+// Range 先按 util.ParseRange 规范化：合并重叠的范围，忽略语法无效或过多的范围，并告知对象预计读取的范围
+func serve(w http.ResponseWriter, r *http.Request, obj *layer.Object, headers http.Header, accept string, v *vhost.Vhost) error {
 	to := w.Header()
 	copyHeader(headers, to, exposeHeaders)
-	w.WriteHeader(statusCode)
-	_, err = io.Copy(w, res)
-	return err
+	copyHeader(headers, to, v.Headers)
+	if _, ok := to["Content-Type"]; !ok { // 没有 Content-Type 时不让 ServeContent 读取内容猜测类型
+		to["Content-Type"] = nil
+	}
+	ranges, err := util.ParseRange(r.Header.Get("Range"), obj.Size())
+	switch {
+	case err != nil: // 改写为 ServeContent 同样判定为不可满足的形式，由其在条件求值之后返回 416 及 Content-Range: bytes */长度
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-", obj.Size()))
+	case ranges == nil:
+		r.Header.Del("Range")
+	default:
+		r.Header.Set("Range", util.FormatRange(ranges))
+		obj.SetRanges(ranges)
+	}
+	modtime, _ := http.ParseTime(headers.Get("Last-Modified"))
+	cw := &compressWriter{ResponseWriter: w, accept: accept, v: v}
+	http.ServeContent(cw, r, "", modtime, obj)
+	return cw.Close()
 }
 
 func copyHeader(from http.Header, to http.Header, headers []string) http.Header {
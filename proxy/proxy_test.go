@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/suconghou/cachelayer/request"
+	"github.com/suconghou/cachelayer/store"
+	"github.com/suconghou/cachelayer/vhost"
+)
+
+// newTestProxy 启动上游及以 mem 为后端的代理，config 为 vhost 的额外配置，代理以 /v/ 转发到上游
+func newTestProxy(t *testing.T, config string, upstream http.HandlerFunc) *httptest.Server {
+	up := httptest.NewServer(upstream)
+	t.Cleanup(up.Close)
+	file := filepath.Join(t.TempDir(), "vhost.json")
+	cfg := fmt.Sprintf(`[{"prefix":"/v/","target":%q,"cachesec":100%s}]`, up.URL, config)
+	if err := os.WriteFile(file, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := vhost.Load(file); err != nil {
+		t.Fatal(err)
+	}
+	backend, err := store.Open("mem", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Init(backend)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Do(w, r, []string{r.URL.Path})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// fetch 发起请求并读取整个响应体
+func fetch(t *testing.T, method, url string, h http.Header) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = h
+	tr := &http.Transport{DisableCompression: true}
+	res, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, b
+}
+
+func TestConditional(t *testing.T) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	var (
+		content = strings.Repeat("cachelayer ", 100)
+		hits    atomic.Int32
+	)
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		modtime, _ := http.ParseTime(lastModified)
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "a.txt", modtime, strings.NewReader(content))
+	}
+	var tests = []struct {
+		name string
+		h    http.Header
+		code int
+	}{
+		{"none match", http.Header{"If-None-Match": {`"v1"`}}, http.StatusNotModified},
+		{"none match weak", http.Header{"If-None-Match": {`"v0", W/"v1"`}}, http.StatusNotModified},
+		{"none match star", http.Header{"If-None-Match": {"*"}}, http.StatusNotModified},
+		{"none match changed", http.Header{"If-None-Match": {`"v2"`}}, http.StatusOK},
+		{"modified since", http.Header{"If-Modified-Since": {lastModified}}, http.StatusNotModified},
+		{"modified since earlier", http.Header{"If-Modified-Since": {"Mon, 02 Jan 2006 15:04:04 GMT"}}, http.StatusOK},
+		{"none match before modified since", http.Header{"If-None-Match": {`"v2"`}, "If-Modified-Since": {lastModified}}, http.StatusOK},
+		{"match", http.Header{"If-Match": {`"v1"`}}, http.StatusOK},
+		{"match weak", http.Header{"If-Match": {`W/"v1"`}}, http.StatusPreconditionFailed},
+		{"match changed", http.Header{"If-Match": {`"v2"`}}, http.StatusPreconditionFailed},
+		{"unmodified since", http.Header{"If-Unmodified-Since": {lastModified}}, http.StatusOK},
+		{"unmodified since earlier", http.Header{"If-Unmodified-Since": {"Mon, 02 Jan 2006 15:04:04 GMT"}}, http.StatusPreconditionFailed},
+		{"if-range", http.Header{"Range": {"bytes=0-9"}, "If-Range": {`"v1"`}}, http.StatusPartialContent},
+		{"if-range date", http.Header{"Range": {"bytes=0-9"}, "If-Range": {lastModified}}, http.StatusPartialContent},
+		{"if-range changed", http.Header{"Range": {"bytes=0-9"}, "If-Range": {`"v2"`}}, http.StatusOK},
+	}
+	for _, strict := range []bool{false, true} {
+		srv := newTestProxy(t, fmt.Sprintf(`,"strictCache":%v`, strict), upstream)
+		if res, _ := fetch(t, http.MethodGet, srv.URL+"/v/a.txt", http.Header{}); res.StatusCode != http.StatusOK {
+			t.Fatalf("warm up: status %d", res.StatusCode)
+		}
+		for _, tt := range tests {
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				hits.Store(0)
+				res, b := fetch(t, method, srv.URL+"/v/a.txt", tt.h.Clone())
+				if res.StatusCode != tt.code {
+					t.Fatalf("strict=%v %s %s: status %d, want %d", strict, method, tt.name, res.StatusCode, tt.code)
+				}
+				if want := map[int]string{http.StatusOK: content, http.StatusPartialContent: content[:10]}[tt.code]; method == http.MethodGet && string(b) != want {
+					t.Fatalf("strict=%v %s %s: body %q", strict, method, tt.name, b)
+				}
+				// 默认只按缓存的校验信息求值，不回源；strictCache 时 If-Range 之外的条件请求交给上游求值
+				if n, forward := hits.Load(), strict && tt.h.Get("If-Range") == ""; (n > 0) != forward {
+					t.Fatalf("strict=%v %s %s: %d upstream requests", strict, method, tt.name, n)
+				}
+			}
+		}
+	}
+}
+
+func TestMultiRange(t *testing.T) {
+	var content = make([]byte, 5000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	srv := newTestProxy(t, `,"chunkSize":1024`, func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "a.bin", time.Time{}, bytes.NewReader(content))
+	})
+	var many []string // 间隔足够大，不会被合并
+	for i := range 20 {
+		many = append(many, fmt.Sprintf("%d-%d", i*200, i*200+9))
+	}
+	var tests = []struct {
+		name   string
+		rng    string
+		code   int
+		ranges [][2]int // 期望返回的范围，多于一个时为 multipart/byteranges
+	}{
+		{"two ranges", "bytes=0-99,2000-2099", http.StatusPartialContent, [][2]int{{0, 99}, {2000, 2099}}},
+		{"across chunks", "bytes=1000-1100,-10", http.StatusPartialContent, [][2]int{{1000, 1100}, {4990, 4999}}},
+		{"unsorted", "bytes=3000-3009,100-109", http.StatusPartialContent, [][2]int{{100, 109}, {3000, 3009}}},
+		{"overlapping", "bytes=0-99,50-149", http.StatusPartialContent, [][2]int{{0, 149}}},
+		{"close together", "bytes=0-9,20-29", http.StatusPartialContent, [][2]int{{0, 29}}},
+		{"unsatisfiable ignored", "bytes=0-9,9000-9009", http.StatusPartialContent, [][2]int{{0, 9}}},
+		{"too many", "bytes=" + strings.Join(many, ","), http.StatusOK, [][2]int{{0, 4999}}},
+		{"all unsatisfiable", "bytes=6000-6009,7000-", http.StatusRequestedRangeNotSatisfiable, nil},
+	}
+	for _, tt := range tests {
+		res, b := fetch(t, http.MethodGet, srv.URL+"/v/a.bin", http.Header{"Range": {tt.rng}})
+		if res.StatusCode != tt.code {
+			t.Fatalf("%s: status %d, want %d", tt.name, res.StatusCode, tt.code)
+		}
+		mediaType, params, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if len(tt.ranges) < 2 {
+			if mediaType == "multipart/byteranges" {
+				t.Fatalf("%s: unexpected multipart response", tt.name)
+			}
+			if len(tt.ranges) == 1 && !bytes.Equal(b, content[tt.ranges[0][0]:tt.ranges[0][1]+1]) {
+				t.Fatalf("%s: body mismatch", tt.name)
+			}
+			continue
+		}
+		if mediaType != "multipart/byteranges" {
+			t.Fatalf("%s: Content-Type %q", tt.name, res.Header.Get("Content-Type"))
+		}
+		mr := multipart.NewReader(bytes.NewReader(b), params["boundary"])
+		for _, r := range tt.ranges {
+			part, err := mr.NextPart()
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if want := fmt.Sprintf("bytes %d-%d/%d", r[0], r[1], len(content)); part.Header.Get("Content-Range") != want {
+				t.Fatalf("%s: Content-Range %q, want %q", tt.name, part.Header.Get("Content-Range"), want)
+			}
+			if p, _ := io.ReadAll(part); !bytes.Equal(p, content[r[0]:r[1]+1]) {
+				t.Fatalf("%s: part %v mismatch", tt.name, r)
+			}
+		}
+		if _, err := mr.NextPart(); err != io.EOF {
+			t.Fatalf("%s: extra parts: %v", tt.name, err)
+		}
+	}
+}
@@ -7,16 +7,35 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/suconghou/cachelayer/layer"
+	"github.com/suconghou/cachelayer/store"
 	"github.com/suconghou/cachelayer/util"
+	"github.com/suconghou/cachelayer/vhost"
 )
 
 var (
-	HttpProvider = newHttpGeter()
+	HttpProvider *httpGeter
+	probes       util.Group[*layer.ObjectMeta]
+	revalidates  util.Group[revalidation]
+	teeing       sync.Map // 正在整体缓存的对象，同一对象同时只缓存一份
+
+	// CondHeaders 是客户端的条件请求头，vhost 配置 strictCache 时转发给上游求值
+	// If-Range 只决定是否按 Range 返回部分内容，上游的 304/412 无法表达其结果，总是根据缓存的校验信息求值
+	CondHeaders = []string{
+		"If-Match",
+		"If-None-Match",
+		"If-Modified-Since",
+		"If-Unmodified-Since",
+	}
 )
 
 const (
+	maxErrorBody = 64 << 10 // 上游错误响应最多保留的响应体大小
+	passTTL      = 60       // 上游不允许缓存的对象在这段时间内（单位：秒）不再探测，直接回源
+
 	cr = "Content-Range"
 	cl = "Content-Length"
 	rr = "Range"
@@ -33,91 +52,156 @@ func (b *buffer) Close() error {
 }
 
 type httpGeter struct {
+	backend store.Backend
 }
 
-func newHttpGeter() *httpGeter {
-	return &httpGeter{}
+func newHttpGeter(backend store.Backend) *httpGeter {
+	return &httpGeter{backend}
 }
 
-// 此处我们需要确认目标是否支持range，及其大小
-func (l *httpGeter) Get(url string, reqHeaders http.Header, client *http.Client, ttl int64) (io.ReadCloser, int, http.Header, error) {
+// Init 设置缓存使用的存储后端
+func Init(backend store.Backend) {
+	HttpProvider = newHttpGeter(backend)
+}
+
+// prober 在元信息未缓存时探测上游，可以缓存时返回元信息，否则返回上游的响应
+type prober func(url string, reqHeaders http.Header, v *vhost.Vhost, chunkSize int64, obj *object) (io.ReadCloser, int, http.Header, *layer.ObjectMeta, error)
+
+// lookup 读取缓存键为 key 的对象的元信息，过期时重新验证，未缓存时探测上游，返回 nil 元信息时直接使用返回的上游响应
+// method 为 HEAD 时只用 HEAD 请求探测，已知不允许缓存的对象按 method 直接回源
+// reqHeaders 用于探测及重新验证，总是请求未编码的内容；fwdHeaders 是客户端原本的请求头，直接回源（不缓存）时使用
+func (l *httpGeter) lookup(method string, url string, key string, reqHeaders http.Header, fwdHeaders http.Header, v *vhost.Vhost) (layer.CacheStore, io.ReadCloser, int, http.Header, *layer.ObjectMeta, error) {
 	var (
-		cacheKey     = util.Md5([]byte(url))
-		cacheKeyMeta = bytes.Join([][]byte{cacheKey, []byte("meta")}, []byte(":"))
-		start, end   = util.GetRange(reqHeaders.Get(rr))
-		cstore       = layer.NewCacheStore(cacheKey)
-		minfo, err   = layer.LoadMeta(cacheKeyMeta)
+		chunkSize    = int64(v.ChunkSize)
+		probe, fetch = prober(l.probe), Get
+		obj          = newObject(l.backend, key, reqHeaders)
+		minfo, err   = obj.load()
 	)
-	if minfo == nil {
-		if err != nil {
-			return nil, 0, nil, err
-		}
-		res, code, h, ll, err := part1(url, reqHeaders.Clone(), client)
-		if err != nil {
-			return res, code, h, err
-		}
-		if ll < 1 || code != http.StatusPartialContent { // 不支持range，直接返回响应体
-			return res, code, h, nil
-		}
-		if ll < layer.ChunkSize { // 文件太小, 我们检查，用户是否请求了range，把内容切割出来
-			b, err := ReadBytes(res, ll)
-			if err != nil { // 读取body时发生错误，有可能超时，或者http协议不规范，响应头与响应体字节数不一致
-				return b, code, h, err
-			}
-			if (start > 0 || end > 0) && start < ll { // 有请求range，需要切割响应体
-				if end == 0 || end >= ll {
-					end = ll - 1
-				}
-				bb := bytes.NewBuffer(b.Bytes()[start : end+1])
-				h.Set(cl, strconv.Itoa(bb.Len()))
-				h.Set(cr, fmt.Sprintf("bytes %d-%d/%d", start, end, ll))
-				return &buffer{bb}, code, h, nil
+	if chunkSize <= 0 {
+		chunkSize = layer.ChunkSize
+	}
+	if method == http.MethodHead {
+		probe, fetch = l.probeHead, Head
+	}
+	if minfo != nil && minfo.Pass && !minfo.Stale() { // 不允许缓存，按客户端原本的请求回源
+		res, code, h, err := fetch(url, fwdHeaders, v.Client())
+		return obj.cstore, res, code, h, nil, err
+	}
+	if minfo != nil && minfo.Stale() {
+		if minfo.Status != 0 || minfo.Pass { // 缓存的错误响应及不允许缓存的标记过期后直接重新探测
+			minfo = nil
+		} else {
+			var r revalidation
+			if minfo, r = l.refresh(url, reqHeaders, v, obj.cstore, minfo); r.err != nil {
+				// 上游不可用时保留旧对象，等上游恢复后再重新验证，本次返回上游的错误
+				return obj.cstore, &buffer{bytes.NewBuffer([]byte(""))}, r.code, r.h, nil, r.err
 			}
-			h.Set(cl, strconv.Itoa(b.Len()))
-			h.Del(cr)
-			return b, http.StatusOK, h, nil
-		}
-		// 否则，支持range，文件大小也符合
-		b, err := ReadBytes(res, layer.ChunkSize)
-		if err != nil { // 应该读取 262144 字节，可能网络超时，或者http协议不规范，读取的响应体比预期大
-			return b, code, h, err
 		}
-		if err = cstore.Set([]byte("0"), b.Bytes(), ttl); err != nil {
-			return b, code, h, err // 写盘错误
+	}
+	if minfo == nil {
+		if err != nil {
+			return obj.cstore, nil, 0, nil, nil, err
 		}
-		if minfo, err = layer.SetMeta(cacheKeyMeta, ll, h, ttl); err != nil { // 存储或序列化失败
-			return b, code, h, err
+		var (
+			res    io.ReadCloser
+			code   int // 探测不可缓存且需要按客户端的请求回源时、或者等待其他请求的探测时为 0
+			h      http.Header
+			shared bool
+		)
+		// 同一对象并发的首次请求只发起一次探测，其余请求等待探测完成后共享其元信息
+		minfo, shared = probes.Do(string(obj.cstore.Key()), func() *layer.ObjectMeta {
+			var m *layer.ObjectMeta
+			res, code, h, m, err = probe(url, reqHeaders, v, chunkSize, obj)
+			return m
+		})
+		if shared && minfo != nil { // 探测到的可能是其他变体，按自己的请求头重新读取
+			minfo, err = obj.load()
 		}
-		if start >= ll || end >= ll {
-			h.Set(cl, "0")
-			h.Del(cr)
-			return &buffer{bytes.NewBuffer([]byte(""))}, http.StatusRequestedRangeNotSatisfiable, h, nil
+		if minfo != nil {
+			minfo = minfo.Clone() // 各个请求都会修改响应头，不能直接共享
+		} else if code == 0 && err == nil { // 探测结果不可缓存，按客户端原本的请求头自行请求
+			res, code, h, err = fetch(url, fwdHeaders, v.Client())
 		}
+		return obj.cstore, res, code, h, minfo, err
 	}
-	var statusCode = http.StatusPartialContent
-	if start >= minfo.Length || end >= minfo.Length {
-		return &buffer{bytes.NewBuffer([]byte(""))}, http.StatusRequestedRangeNotSatisfiable, minfo.Header, nil
-	} else if start < 1 && end < 1 {
-		statusCode = http.StatusOK
+	if minfo.Status != 0 {
+		obj.touch(0) // 缓存的错误响应不延长有效期
+	} else {
+		obj.touch(v.TouchTTL()) // 命中缓存时延长整个对象的有效期，只记录在内存中
 	}
-	if end <= 0 || end >= minfo.Length {
-		end = minfo.Length - 1
+	return obj.cstore, nil, 0, nil, minfo, nil
+}
+
+// Open 打开 url 对应的缓存对象，key 为缓存键，method 为 HEAD 时未缓存的对象只向上游发送 HEAD 请求探测元信息，不传输响应体也不写入分片
+// 对象可以缓存时返回 *layer.Object 及其响应头，由调用方按 Range 与条件请求头读取；否则返回上游的响应（包括缓存的错误响应）及其状态码
+// 填充缓存的回源请求始终使用 Accept-Encoding: identity，分片是原始内容的字节范围；不缓存的响应按客户端的 Accept-Encoding 回源
+func (l *httpGeter) Open(method string, url string, key string, reqHeaders http.Header, v *vhost.Vhost) (*layer.Object, io.ReadCloser, int, http.Header, error) {
+	var fwdHeaders = reqHeaders
+	reqHeaders = identity(reqHeaders)
+	cstore, res, code, h, minfo, err := l.lookup(method, url, key, reqHeaders, fwdHeaders, v)
+	if minfo == nil {
+		return nil, res, code, h, err
 	}
-	if start > end {
-		start = end
+	if minfo.Status != 0 {
+		minfo.Header.Set(cl, strconv.Itoa(len(minfo.Body)))
+		return nil, &buffer{bytes.NewBuffer(minfo.Body)}, minfo.Status, minfo.Header, nil
 	}
-	data := layer.NewCacheLayer(func(tu string, hd http.Header) (io.ReadCloser, int, http.Header, error) { return Get(tu, hd, client) }, url, cstore, start, end, reqHeaders, minfo.Length, ttl)
-	if statusCode == http.StatusOK {
-		minfo.Header.Set(cl, strconv.FormatInt(minfo.Length, 10))
-	} else {
-		minfo.Header.Set(cl, strconv.FormatInt(end-start+1, 10))
-		minfo.Header.Set(cr, fmt.Sprintf("bytes %d-%d/%d", start, end, minfo.Length))
+	metaHeader(minfo)
+	var client = v.Client()
+	return layer.NewObject(func(tu string, hd http.Header) (io.ReadCloser, int, http.Header, error) { return Get(tu, hd, client) }, url, cstore, reqHeaders, minfo, int64(v.Readahead)), nil, http.StatusOK, minfo.Header, nil
+}
+
+// Check 把客户端的条件请求转发给上游求值，上游返回 304 或 412 时返回该状态码，否则返回 0
+func (l *httpGeter) Check(url string, reqHeaders http.Header, cond http.Header, v *vhost.Vhost) (int, http.Header, error) {
+	var headers = identity(reqHeaders) // 与缓存的对象一样按未编码的内容求值
+	for k, vv := range cond {
+		headers[k] = vv
+	}
+	headers.Set(rr, "bytes=0-0") // 条件满足时只取一个字节
+	res, code, h, err := Get(url, headers, v.Client())
+	if res != nil {
+		res.Close()
+	}
+	if code == http.StatusNotModified || code == http.StatusPreconditionFailed {
+		return code, h, nil
+	}
+	if code == 0 {
+		return 0, nil, err
+	}
+	return 0, nil, nil
+}
+
+// identity 返回请求未编码内容的请求头
+func identity(reqHeaders http.Header) http.Header {
+	var h = reqHeaders.Clone()
+	h.Set("Accept-Encoding", "identity")
+	return h
+}
+
+// metaHeader 向响应头补充缓存对象支持范围请求、校验信息及 Vary
+func metaHeader(minfo *layer.ObjectMeta) {
+	minfo.Header.Set("Accept-Ranges", "bytes")
+	if minfo.ETag != "" {
+		minfo.Header.Set("ETag", minfo.ETag)
+	}
+	if minfo.LastModified != "" {
+		minfo.Header.Set("Last-Modified", minfo.LastModified)
+	}
+	if len(minfo.Vary) > 0 {
+		minfo.Header.Set("Vary", strings.Join(minfo.Vary, ", "))
 	}
-	return data, statusCode, minfo.Header, err
 }
 
 func Get(target string, reqHeaders http.Header, client *http.Client) (io.ReadCloser, int, http.Header, error) {
-	req, err := http.NewRequest(http.MethodGet, target, nil)
+	return do(http.MethodGet, target, reqHeaders, client)
+}
+
+func Head(target string, reqHeaders http.Header, client *http.Client) (io.ReadCloser, int, http.Header, error) {
+	return do(http.MethodHead, target, reqHeaders, client)
+}
+
+func do(method string, target string, reqHeaders http.Header, client *http.Client) (io.ReadCloser, int, http.Header, error) {
+	req, err := http.NewRequest(method, target, nil)
 	if err != nil {
 		return nil, 0, nil, err
 	}
@@ -126,8 +210,19 @@ func Get(target string, reqHeaders http.Header, client *http.Client) (io.ReadClo
 	if err != nil {
 		return nil, 0, nil, err
 	}
-	if resp.StatusCode/100 != 2 {
-		return nil, resp.StatusCode, resp.Header, errors.Join(resp.Body.Close(), fmt.Errorf("%s %s : %s", resp.Request.Method, resp.Request.URL, resp.Status))
+	if resp.StatusCode/100 != 2 { // 保留截断后的响应体，以便原样转发或缓存错误响应
+		err = fmt.Errorf("%s %s : %s", resp.Request.Method, resp.Request.URL, resp.Status)
+		b, e := ReadBytes(struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(resp.Body, maxErrorBody), resp.Body}, maxErrorBody)
+		if e != nil {
+			return nil, resp.StatusCode, resp.Header, errors.Join(e, err)
+		}
+		if method != http.MethodHead { // 响应体可能被截断，长度以保留的为准，否则客户端会等待缺失的部分
+			resp.Header.Set(cl, strconv.Itoa(b.Len()))
+		}
+		return b, resp.StatusCode, resp.Header, err
 	}
 	return resp.Body, resp.StatusCode, resp.Header, nil
 }
@@ -154,12 +249,233 @@ func ReadBytes(r io.ReadCloser, max int64) (*buffer, error) {
 	return &buffer{buf}, nil
 }
 
-// 传入的http.Header必须是clone后的，修改不会干扰源数据,请求前256kb数据
-func part1(url string, reqHeaders http.Header, client *http.Client) (io.ReadCloser, int, http.Header, int64, error) {
-	reqHeaders.Set(rr, "bytes=0-262143")
+// probe 首次请求时探测上游是否支持range及其大小，可以缓存时存储首个分片和元信息并返回元信息，否则直接返回响应
+// 返回元信息时由调用方从缓存读取内容，对象不大于一个分片时之后的请求全部命中缓存
+func (l *httpGeter) probe(url string, reqHeaders http.Header, v *vhost.Vhost, chunkSize int64, obj *object) (io.ReadCloser, int, http.Header, *layer.ObjectMeta, error) {
+	res, code, h, ll, err := part1(url, reqHeaders.Clone(), v.Client(), chunkSize)
+	if err != nil {
+		if ttl := int64(v.NegativeTTL[code]); ttl > 0 && res != nil {
+			return nil, code, h, l.negative(res, code, h, v, ttl, obj), nil
+		}
+		return res, code, h, nil, err
+	}
+	ttl, ok := v.TTL(h)
+	if !ok { // 上游不允许缓存，记录下来之后不再探测；响应是完整内容时直接返回，否则由调用方按客户端原本的请求重新回源
+		l.pass(h, obj)
+		if code == http.StatusOK {
+			return res, code, h, nil, nil
+		}
+		res.Close()
+		return nil, 0, nil, nil, nil
+	}
+	cstore, err := obj.resolve(h, v.Retention(ttl))
+	if err != nil {
+		return nil, code, h, nil, errors.Join(res.Close(), err)
+	}
+	if code == http.StatusOK && v.FullObject && h.Get("Content-Encoding") == "" { // 不支持range，边转发边缓存整个对象
+		if _, ok := teeing.LoadOrStore(string(cstore.Key()), true); !ok {
+			if err = cstore.Remove(); err != nil { // 同下，先删除旧版本的分片
+				teeing.Delete(string(cstore.Key()))
+				return nil, code, h, nil, errors.Join(res.Close(), err)
+			}
+			length, err := strconv.ParseInt(h.Get(cl), 10, 64)
+			if err != nil {
+				length = -1
+			}
+			save := func(total int64) error {
+				return cstore.SetMeta(layer.NewObjectMeta(total, chunkSize, h, v.Headers, ttl), v.Retention(ttl))
+			}
+			return layer.NewObjectTee(res, cstore, chunkSize, length, save, func() { teeing.Delete(string(cstore.Key())) }), code, h, nil, nil
+		}
+	}
+	if ll < 1 || code != http.StatusPartialContent { // 不支持range，直接返回响应体
+		return res, code, h, nil, nil
+	}
+	// 支持range，存储首个分片，小于一个分片的对象整个作为首个分片存储
+	n := min(ll, chunkSize)
+	b, err := ReadBytes(res, n)
+	if err != nil { // 应该读取 n 字节，可能网络超时，或者http协议不规范，读取的响应体比预期大
+		return b, code, h, nil, err
+	}
+	if int64(b.Len()) != n { // 响应体比预期小，不能当作完整的分片存储
+		return nil, code, h, nil, errors.Join(b.Close(), io.ErrUnexpectedEOF)
+	}
+	defer b.Close()
+	// 重新探测时存储中可能还有旧版本的分片，先整体删除，新的元信息不会与旧分片混在一起
+	if err = cstore.Remove(); err != nil {
+		return nil, code, h, nil, err
+	}
+	if err = cstore.Set([]byte("0"), b.Bytes()); err != nil && !errors.Is(err, store.ErrQueueFull) {
+		return nil, code, h, nil, err // 写盘错误，队列已满时首个分片之后再按需回源
+	}
+	minfo := layer.NewObjectMeta(ll, chunkSize, h, v.Headers, ttl)
+	if err = cstore.SetMeta(minfo, v.Retention(ttl)); err != nil { // 存储或序列化失败
+		return nil, code, h, nil, err
+	}
+	return nil, code, h, minfo, nil
+}
+
+// probeHead 用 HEAD 请求探测上游是否支持range及其大小，可以缓存时只存储元信息，分片在之后的 GET 请求时再填充
+func (l *httpGeter) probeHead(url string, reqHeaders http.Header, v *vhost.Vhost, chunkSize int64, obj *object) (io.ReadCloser, int, http.Header, *layer.ObjectMeta, error) {
+	var headers = reqHeaders.Clone()
+	headers.Set(rr, "bytes=0-0")
+	res, code, h, err := Head(url, headers, v.Client())
+	if err != nil {
+		return res, code, h, nil, err
+	}
+	res.Close()
+	ll := util.GetLen(h.Get(cr))
+	if code != http.StatusPartialContent || ll < 1 { // 不支持range，直接返回上游的响应头
+		return nil, code, h, nil, nil
+	}
+	ttl, ok := v.TTL(h)
+	if !ok { // 不允许缓存，记录下来之后不再探测，把范围响应的响应头还原为完整响应
+		l.pass(h, obj)
+		h.Set(cl, strconv.FormatInt(ll, 10))
+		h.Del(cr)
+		return nil, http.StatusOK, h, nil, nil
+	}
+	cstore, err := obj.resolve(h, v.Retention(ttl))
+	if err == nil { // 同 probe，先删除旧版本的分片再保存元信息
+		err = cstore.Remove()
+	}
+	if err != nil {
+		return nil, code, h, nil, err
+	}
+	minfo := layer.NewObjectMeta(ll, chunkSize, h, v.Headers, ttl)
+	if err = cstore.SetMeta(minfo, v.Retention(ttl)); err != nil {
+		return nil, code, h, nil, err
+	}
+	return nil, code, h, minfo, nil
+}
+
+// negative 缓存上游的错误响应，保存状态码及截断后的响应体，有效期到了直接删除而不重新验证
+func (l *httpGeter) negative(res io.ReadCloser, code int, h http.Header, v *vhost.Vhost, ttl int64, obj *object) *layer.ObjectMeta {
+	defer res.Close()
+	var minfo = layer.NewObjectMeta(0, 0, h, v.Headers, ttl)
+	minfo.Status = code
+	if b, ok := res.(*buffer); ok {
+		minfo.Body = bytes.Clone(b.Bytes())
+	}
+	cstore, err := obj.resolve(h, ttl)
+	if err == nil {
+		err = cstore.SetMeta(minfo, ttl)
+	}
+	if err != nil {
+		util.Log.Print(err)
+	}
+	return minfo
+}
+
+// pass 记录上游不允许缓存的对象，passTTL 内的请求不再探测而直接回源
+func (l *httpGeter) pass(h http.Header, obj *object) {
+	var minfo = &layer.ObjectMeta{Header: http.Header{}, Pass: true}
+	minfo.Refresh(passTTL)
+	cstore, err := obj.resolve(h, passTTL)
+	if err == nil {
+		err = cstore.SetMeta(minfo, passTTL)
+	}
+	if err != nil {
+		util.Log.Print(err)
+	}
+}
+
+// revalidation 是一次重新验证的结果，meta 为 nil 且 err 为 nil 表示对象已变化并已删除
+// 上游不可用时 err 不为 nil，code、h 为上游的状态码与响应头，网络错误时 code 为 0
+type revalidation struct {
+	meta *layer.ObjectMeta
+	code int
+	h    http.Header
+	err  error
+}
+
+// revalidate 向上游发起条件请求确认过期的对象是否变化，未变化时刷新新鲜期并返回新的元信息
+// 只有确认对象已变化、已不存在（404/410）或无法验证时才删除整个对象；
+// 其余情况（网络错误、5xx 及其他错误状态码）视为上游不可用，保留对象并返回错误，以便继续使用旧内容
+func (l *httpGeter) revalidate(url string, reqHeaders http.Header, v *vhost.Vhost, cstore layer.CacheStore, stale *layer.ObjectMeta) revalidation {
+	var headers = reqHeaders.Clone()
+	headers.Set(rr, "bytes=0-0") // 上游不支持条件请求或对象已变化时，只取一个字节
+	if stale.Conditional(headers) {
+		res, code, h, err := Get(url, headers, v.Client())
+		if res != nil {
+			res.Close()
+		}
+		if code == 0 || (code >= http.StatusBadRequest && code != http.StatusNotFound && code != http.StatusGone) {
+			return revalidation{code: code, h: h, err: err}
+		}
+		// 304 或者返回的片段仍与元信息一致，都说明对象没有变化
+		if code == http.StatusNotModified || (err == nil && stale.Validate(code, h) == nil) {
+			// RFC 9111 4.3.4：用 304 的响应头更新缓存的响应头，304 常常不带 Cache-Control，有效期按合并后的响应头计算
+			var merged = stale.Header.Clone()
+			for k, vv := range h {
+				merged[k] = vv
+			}
+			if ttl, ok := v.TTL(merged); ok {
+				minfo := stale.Clone()
+				for k := range minfo.Header { // 只更新已保存的响应头
+					if vv, ok := h[k]; ok {
+						minfo.Header[k] = vv
+					}
+				}
+				minfo.Refresh(ttl)
+				if err = cstore.SetMeta(minfo, v.Retention(ttl)); err == nil {
+					return revalidation{meta: minfo}
+				}
+				util.Log.Print(err)
+			}
+		}
+	}
+	if err := cstore.Remove(); err != nil {
+		util.Log.Print(err)
+	}
+	return revalidation{}
+}
+
+// refresh 处理已过新鲜期的对象，返回可以继续使用的元信息，返回 nil 时需要重新探测
+// 过期不久（staleWhileRevalidate 内）时直接返回旧内容并在后台重新验证；
+// 否则同步重新验证，上游不可用且在 staleIfError 内时返回旧内容，旧内容的响应头带有 Warning 与 Cache-Status；
+// 超出 staleIfError 时返回带有错误的重新验证结果，旧对象保留在缓存中
+func (l *httpGeter) refresh(url string, reqHeaders http.Header, v *vhost.Vhost, cstore layer.CacheStore, stale *layer.ObjectMeta) (*layer.ObjectMeta, revalidation) {
+	var (
+		key     = string(cstore.Key())
+		overdue = stale.Overdue()
+		fn      = func() revalidation { return l.revalidate(url, reqHeaders, v, cstore, stale) }
+	)
+	if overdue < int64(v.StaleWhileRevalidate) {
+		go revalidates.Do(key, fn)
+		return markStale(stale.Clone(), overdue, `110 - "Response is Stale"`, "stale-while-revalidate"), revalidation{}
+	}
+	// 同一对象并发的请求只发起一次重新验证
+	r, _ := revalidates.Do(key, fn)
+	if r.meta != nil {
+		return r.meta.Clone(), r
+	}
+	if r.err == nil {
+		return nil, r
+	}
+	if overdue < int64(v.StaleIfError) {
+		util.Log.Printf("%s revalidate failed, serve stale: %s", url, r.err)
+		return markStale(stale.Clone(), overdue, `111 - "Revalidation Failed"`, "stale-if-error"), revalidation{}
+	}
+	if r.h != nil {
+		r.h = r.h.Clone() // 并发等待的请求共享同一个结果，各自修改响应头
+		r.h.Del(cl)       // 不返回上游的响应体
+	}
+	return nil, r
+}
+
+func markStale(minfo *layer.ObjectMeta, overdue int64, warning string, detail string) *layer.ObjectMeta {
+	minfo.Header.Set("Warning", warning)
+	minfo.Header.Set("Cache-Status", fmt.Sprintf("cachelayer; hit; ttl=%d; detail=%s", -overdue, detail))
+	return minfo
+}
+
+// 传入的http.Header必须是clone后的，修改不会干扰源数据,请求首个分片的数据
+func part1(url string, reqHeaders http.Header, client *http.Client, chunkSize int64) (io.ReadCloser, int, http.Header, int64, error) {
+	reqHeaders.Set(rr, fmt.Sprintf("bytes=0-%d", chunkSize-1))
 	b, code, h, err := Get(url, reqHeaders, client)
 	if err != nil {
-		return nil, code, h, 0, err
+		return b, code, h, 0, err
 	}
 	l := util.GetLen(h.Get(cr))
 	return b, code, h, l, nil
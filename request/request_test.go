@@ -0,0 +1,183 @@
+package request
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/suconghou/cachelayer/store"
+	"github.com/suconghou/cachelayer/vhost"
+)
+
+func TestErrorBodyLength(t *testing.T) {
+	var tests = []struct {
+		name   string
+		method string
+		size   int
+		want   int // 期望的 Content-Length
+	}{
+		{"small", http.MethodGet, 100, 100},
+		{"truncated", http.MethodGet, maxErrorBody + 1000, maxErrorBody},
+		{"head", http.MethodHead, maxErrorBody + 1000, maxErrorBody + 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(cl, strconv.Itoa(tt.size))
+				w.WriteHeader(http.StatusNotFound)
+				if r.Method != http.MethodHead {
+					w.Write([]byte(strings.Repeat("x", tt.size)))
+				}
+			}))
+			defer srv.Close()
+			res, code, h, err := do(tt.method, srv.URL, http.Header{}, srv.Client())
+			if err == nil || code != http.StatusNotFound {
+				t.Fatalf("code = %d, err = %v", code, err)
+			}
+			defer res.Close()
+			if got := h.Get(cl); got != strconv.Itoa(tt.want) {
+				t.Fatalf("Content-Length = %s, want %d", got, tt.want)
+			}
+			if b := res.(*buffer); tt.method != http.MethodHead && b.Len() != tt.want {
+				t.Fatalf("body = %d bytes, want %d", b.Len(), tt.want)
+			}
+		})
+	}
+}
+
+// testVhost 加载以 target 为上游的 vhost，config 为额外的配置
+func testVhost(t *testing.T, target string, config string) *vhost.Vhost {
+	file := filepath.Join(t.TempDir(), "vhost.json")
+	cfg := fmt.Sprintf(`[{"prefix":"/","target":%q,"cachesec":100%s}]`, target, config)
+	if err := os.WriteFile(file, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := vhost.Load(file); err != nil {
+		t.Fatal(err)
+	}
+	_, v := vhost.Parse("/")
+	return v
+}
+
+func TestRevalidate(t *testing.T) {
+	const (
+		v1 = "version one of the object"
+		v2 = "VERSION TWO OF THE OBJECT"
+	)
+	var tests = []struct {
+		name    string
+		config  string
+		overdue int64  // 对象已过期的秒数
+		origin  string // 重新验证时上游的状态：same、changed、gone、down
+		code    int
+		body    string
+		warning string
+		fresh   bool  // 对象最终是否已刷新为新鲜
+		hits    int32 // 过期后上游收到的请求数，未变化时只有一次条件请求，不重新下载
+	}{
+		{"not modified", "", 100, "same", http.StatusOK, v1, "", true, 1},
+		{"changed", "", 100, "changed", http.StatusOK, v2, "", true, 2},
+		{"gone", "", 100, "gone", http.StatusNotFound, "", "", false, 2},
+		{"stale while revalidate", `,"staleWhileRevalidate":60`, 5, "same", http.StatusOK, v1, "110", true, 1},
+		{"stale if error", `,"staleIfError":60`, 5, "down", http.StatusOK, v1, "111", false, 1},
+		{"error beyond stale if error", `,"staleIfError":60`, 100, "down", http.StatusInternalServerError, "", "", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				state       atomic.Value
+				conditional atomic.Int32 // 带校验信息的重新验证请求数
+				hits        atomic.Int32
+			)
+			state.Store("same")
+			up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				if r.Header.Get("If-None-Match") != "" {
+					conditional.Add(1)
+				}
+				var content, etag = v1, `"v1"`
+				switch state.Load() {
+				case "changed":
+					content, etag = v2, `"v2"`
+				case "gone":
+					http.NotFound(w, r)
+					return
+				case "down":
+					http.Error(w, "down", http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("ETag", etag)
+				http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+			}))
+			defer up.Close()
+			var (
+				v          = testVhost(t, up.URL, tt.config)
+				url        = up.URL + "/a.txt"
+				backend, _ = store.Open("mem", "", 0)
+				l          = newHttpGeter(backend)
+			)
+			open := func() (int, string, http.Header) {
+				obj, res, code, h, err := l.Open(http.MethodGet, url, url, http.Header{}, v)
+				if obj == nil {
+					if res != nil {
+						res.Close()
+					}
+					if code == 0 {
+						t.Fatal(err)
+					}
+					return code, "", h
+				}
+				defer obj.Close()
+				b, err := io.ReadAll(obj)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return code, string(b), h
+			}
+			if code, body, _ := open(); code != http.StatusOK || body != v1 {
+				t.Fatalf("first request: %d %q", code, body)
+			}
+			obj := newObject(backend, url, identity(http.Header{}))
+			minfo, err := obj.load()
+			if err != nil || minfo == nil {
+				t.Fatalf("object not cached: %v", err)
+			}
+			minfo.Expires = time.Now().Unix() - tt.overdue
+			if err = obj.cstore.SetMeta(minfo, 3600); err != nil {
+				t.Fatal(err)
+			}
+			state.Store(tt.origin)
+			hits.Store(0)
+			code, body, h := open()
+			if code != tt.code || body != tt.body {
+				t.Fatalf("status %d body %q, want %d %q", code, body, tt.code, tt.body)
+			}
+			if got := h.Get("Warning"); (tt.warning == "" && got != "") || !strings.HasPrefix(got, tt.warning) {
+				t.Fatalf("Warning = %q, want %s", got, tt.warning)
+			}
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) { // stale-while-revalidate 在后台重新验证
+				minfo, _ = newObject(backend, url, identity(http.Header{})).load()
+				if fresh := minfo != nil && minfo.Status == 0 && !minfo.Stale(); fresh == tt.fresh {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("fresh = %v, want %v", !tt.fresh, tt.fresh)
+				}
+			}
+			if conditional.Load() != 1 || hits.Load() != tt.hits {
+				t.Fatalf("upstream requests = %d (%d conditional), want %d (1 conditional)", hits.Load(), conditional.Load(), tt.hits)
+			}
+			if tt.origin == "down" && minfo == nil { // 上游不可用时保留旧对象
+				t.Fatal("stale object dropped while origin is down")
+			}
+		})
+	}
+}
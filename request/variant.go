@@ -0,0 +1,103 @@
+package request
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/suconghou/cachelayer/layer"
+	"github.com/suconghou/cachelayer/store"
+	"github.com/suconghou/cachelayer/util"
+)
+
+// object 是一个缓存键对应的缓存，上游响应没有 Vary 时对象直接存放在缓存键下；
+// 有 Vary 时缓存键下只保存变体索引（记录 Vary 的请求头），每个变体按这些请求头规范化后的取值分别存储
+type object struct {
+	key        string
+	reqHeaders http.Header
+	base       layer.CacheStore  // 缓存键对应的对象
+	cstore     layer.CacheStore  // 当前请求对应的对象，没有变体时即 base
+	index      *layer.ObjectMeta // 变体索引，没有变体时为 nil
+	backend    store.Backend
+}
+
+func newObject(backend store.Backend, key string, reqHeaders http.Header) *object {
+	base := layer.NewCacheStore(backend, util.Md5([]byte(key)))
+	return &object{key: key, reqHeaders: reqHeaders, base: base, cstore: base, backend: backend}
+}
+
+// load 读取当前请求对应的对象的元信息，缓存键下是变体索引时读取与请求头匹配的变体
+func (o *object) load() (*layer.ObjectMeta, error) {
+	o.cstore, o.index = o.base, nil
+	minfo, err := o.base.LoadMeta()
+	if minfo == nil || !minfo.Index {
+		return minfo, err
+	}
+	o.index = minfo
+	o.cstore = o.variant(minfo.Vary)
+	return o.cstore.LoadMeta()
+}
+
+// resolve 根据上游响应的 Vary 选择保存本次响应的对象，有 Vary 时同时写入变体索引，keep 为本次变体的保留时间
+// 索引的 Expires 记录其保留截止时间，索引由所有变体共用，保留时间只延长不缩短，Vary 不变且无需延长时不重复写入
+func (o *object) resolve(h http.Header, keep int64) (layer.CacheStore, error) {
+	vary := util.Vary(h)
+	if len(vary) == 0 {
+		o.cstore = o.base
+		return o.cstore, nil
+	}
+	if o.index == nil { // 缓存键下原有的不分变体的对象不再使用
+		if err := o.base.Remove(); err != nil {
+			return nil, err
+		}
+	}
+	index := &layer.ObjectMeta{Header: http.Header{}, Vary: vary, Index: true}
+	index.Refresh(keep)
+	if o.index != nil {
+		if o.index.Expires <= 0 || (index.Expires > 0 && index.Expires <= o.index.Expires) {
+			if slices.Equal(o.index.Vary, vary) {
+				o.cstore = o.variant(vary)
+				return o.cstore, nil
+			}
+			index.Expires = o.index.Expires
+		}
+	}
+	keep = 0
+	if index.Expires > 0 {
+		keep = max(index.Expires-time.Now().Unix(), 1)
+	}
+	if err := o.base.SetMeta(index, keep); err != nil {
+		return nil, err
+	}
+	o.index = index
+	o.cstore = o.variant(vary)
+	return o.cstore, nil
+}
+
+// touch 记录一次访问，命中变体时同时延长变体索引的有效期
+func (o *object) touch(ttl int64) {
+	if o.index != nil {
+		o.base.Touch(ttl)
+	}
+	o.cstore.Touch(ttl)
+}
+
+// variant 返回与当前请求头匹配的变体，键由缓存键与各个请求头规范化后的取值计算得到
+func (o *object) variant(vary []string) layer.CacheStore {
+	var key = bytes.NewBufferString(o.key)
+	for _, name := range vary {
+		key.WriteString("\n" + name + ":")
+		var values []string
+		for _, v := range o.reqHeaders.Values(name) {
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					values = append(values, item)
+				}
+			}
+		}
+		key.WriteString(strings.Join(values, ","))
+	}
+	return layer.NewCacheStore(o.backend, util.Md5(key.Bytes()))
+}
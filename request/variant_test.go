@@ -0,0 +1,62 @@
+package request
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/suconghou/cachelayer/store"
+)
+
+func TestResolveIndexRetention(t *testing.T) {
+	var tests = []struct {
+		name  string
+		first int64 // 第一次写入变体时的保留时间
+		then  int64 // 之后同一个缓存键的另一次写入（负缓存、不可缓存等）
+		vary  string
+		want  int64 // 索引最终的保留时间，0 表示一直保留
+	}{
+		{"shorter", 3600, passTTL, "Accept", 3600},
+		{"longer", passTTL, 3600, "Accept", 3600},
+		{"forever", 0, passTTL, "Accept", 0},
+		{"become forever", passTTL, 0, "Accept", 0},
+		{"vary changed", 3600, passTTL, "Accept, Origin", 3600},
+	}
+	backend, err := store.Open("mem", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reqHeaders = http.Header{"Accept": {"text/html"}}
+			for _, w := range []struct {
+				keep int64
+				vary string
+			}{{tt.first, "Accept"}, {tt.then, tt.vary}} {
+				obj := newObject(backend, tt.name, reqHeaders)
+				if _, err := obj.load(); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := obj.resolve(http.Header{"Vary": {w.vary}}, w.keep); err != nil {
+					t.Fatal(err)
+				}
+			}
+			obj := newObject(backend, tt.name, reqHeaders)
+			if _, err := obj.load(); err != nil || obj.index == nil {
+				t.Fatalf("index lost: %v", err)
+			}
+			var want int64
+			if tt.want > 0 {
+				want = time.Now().Unix() + tt.want
+			}
+			if got := obj.index.Expires; got < want-1 || got > want {
+				t.Fatalf("index expires = %d, want %d", got, want)
+			}
+			if vary := strings.Split(tt.vary, ", "); !slices.Equal(obj.index.Vary, vary) {
+				t.Fatalf("index vary = %v, want %v", obj.index.Vary, vary)
+			}
+		})
+	}
+}
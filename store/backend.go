@@ -0,0 +1,163 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backend 定义了缓存存储后端，key 形如 <对象>:<名称>，如 <md5>:meta、<md5>:0
+// 同一对象的所有 key 共享 ':' 之前的前缀，有效期以对象为单位记录，过期及容量淘汰时对象整体删除
+type Backend interface {
+	// Get 读取 key 对应的数据，不存在时返回 nil
+	Get([]byte) ([]byte, error)
+
+	// Set 写入数据，数据跟随所属对象一起过期
+	Set([]byte, []byte) error
+
+	// Has 检查 key 是否存在，同时刷新所属对象的最近访问时间
+	Has([]byte) (bool, error)
+
+	// SetTTL 设置对象的有效期（单位：秒），ttl<=0 表示永不过期
+	SetTTL([]byte, int64) error
+
+	// Touch 记录一次对象访问并延长有效期（单位：秒），ttl<=0 时只刷新访问时间
+	// 用于命中缓存的读路径，实现上应只修改内存，由后台定时批量写入存储
+	Touch([]byte, int64)
+
+	// Remove 立即删除整个对象（元信息及全部分片），用于上游内容变化时使缓存失效
+	Remove([]byte) error
+
+	// Expire 删除已过期的对象，对象的全部数据原子地一起删除
+	Expire() error
+}
+
+// removeHook 包装后端自行发起的删除（过期、容量淘汰），remove 执行删除并返回被删除的对象标识
+// 写入队列借此在删除期间暂停写入，并丢弃这些对象排队中的写入
+type removeHook func(remove func() ([]string, error)) error
+
+// run 经过 hook 执行删除，没有设置 hook 时直接删除
+func (h removeHook) run(remove func() ([]string, error)) error {
+	if h == nil {
+		_, err := remove()
+		return err
+	}
+	return h(remove)
+}
+
+// removeHooker 由会自行删除对象的后端实现，应在开始读写前设置
+type removeHooker interface {
+	setRemoveHook(removeHook)
+}
+
+// Opener 根据 dsn 创建后端实例，dsn 的含义由各个后端自行解释，maxSize 为容量上限(字节)，<=0 表示不限制
+type Opener func(dsn string, maxSize int64) (Backend, error)
+
+var (
+	backendsMu sync.Mutex
+	backends   = map[string]Opener{}
+)
+
+func init() {
+	Register("bolt", openBolt)
+	Register("fs", openFS)
+	Register("mem", openMem)
+}
+
+// Register 注册一个后端，重复注册同名后端会覆盖之前的
+func Register(name string, open Opener) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[name] = open
+}
+
+// Open 按名称创建后端
+func Open(name string, dsn string, maxSize int64) (Backend, error) {
+	backendsMu.Lock()
+	open, ok := backends[name]
+	backendsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown store backend %q, available: %v", name, Backends())
+	}
+	return open(dsn, maxSize)
+}
+
+// Backends 返回已注册的后端名称
+func Backends() []string {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// splitKey 将 key 拆分为对象标识与对象内的名称
+func splitKey(key []byte) (string, string) {
+	if i := bytes.IndexByte(key, ':'); i >= 0 {
+		return string(key[:i]), string(key[i+1:])
+	}
+	return string(key), ""
+}
+
+// boltBackend 将数据存放在单个 bbolt 文件的 data bucket 中
+type boltBackend struct {
+	bucket []byte
+}
+
+func openBolt(dsn string, maxSize int64) (Backend, error) {
+	if err := Init(dsn, maxSize); err != nil {
+		return nil, err
+	}
+	return &boltBackend{bucket: []byte("data")}, nil
+}
+
+func (b *boltBackend) Get(key []byte) ([]byte, error) {
+	return Get(b.bucket, key)
+}
+
+func (b *boltBackend) Set(key, value []byte) error {
+	return Set(b.bucket, key, value)
+}
+
+func (b *boltBackend) SetBatch(keys, values [][]byte) error {
+	return SetBatch(b.bucket, keys, values)
+}
+
+func (b *boltBackend) Has(key []byte) (bool, error) {
+	return Touch(b.bucket, key, 0)
+}
+
+func (b *boltBackend) SetTTL(obj []byte, ttl int64) error {
+	return TTLObject(b.bucket, obj, ttl)
+}
+
+func (b *boltBackend) Touch(obj []byte, ttl int64) {
+	TouchObject(b.bucket, obj, ttl)
+}
+
+func (b *boltBackend) Remove(obj []byte) error {
+	return removeObject(string(objectKey(b.bucket, obj)))
+}
+
+func (b *boltBackend) Expire() error {
+	return Expire()
+}
+
+// setRemoveHook 设置全局的 hook，bolt 中的对象标识带有 bucket 前缀，交给 hook 前去掉
+func (b *boltBackend) setRemoveHook(h removeHook) {
+	var prefix = string(b.bucket) + ":"
+	hook = func(remove func() ([]string, error)) error {
+		return h(func() ([]string, error) {
+			objs, err := remove()
+			for i, obj := range objs {
+				objs[i] = strings.TrimPrefix(obj, prefix)
+			}
+			return objs, err
+		})
+	}
+}
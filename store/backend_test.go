@@ -0,0 +1,295 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// testBoltSize 是测试用 bolt 后端的容量上限，bolt 使用全局的数据库，整个测试只打开一次
+const testBoltSize = 1 << 20
+
+var testBolt Backend
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "store")
+	if err != nil {
+		panic(err)
+	}
+	var file = filepath.Join(dir, "test.db")
+	if err = seedLegacyTTL(file); err != nil {
+		panic(err)
+	}
+	if testBolt, err = openBolt(file, testBoltSize); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	db.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+var (
+	legacyExpireAt = time.Now().Unix() + 3600 // 迁移测试中未过期的旧版记录的过期时间
+	legacyChecked  bool                       // 旧版记录只在打开数据库时迁移一次，-count 重复运行时跳过
+)
+
+// seedLegacyTTL 写入旧版本格式（JSON）的 ttl 记录，由 TestMain 在打开数据库之前调用，打开时完成迁移
+func seedLegacyTTL(file string) error {
+	d, err := bolt.Open(file, 0666, nil)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Update(func(tx *bolt.Tx) error {
+		data, err := tx.CreateBucketIfNotExists([]byte("data"))
+		if err != nil {
+			return err
+		}
+		bt, err := tx.CreateBucketIfNotExists(bTTL)
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"legacy-old:meta", "legacy-old:0", "legacy-new:meta", "legacy-key:0", "legacy-key:1"} {
+			if err = data.Put([]byte(k), []byte("v")); err != nil {
+				return err
+			}
+		}
+		var records = map[string]string{
+			"data:legacy-old":   `[1,"data:legacy-old"]`,
+			"data:legacy-new":   fmt.Sprintf(`[%d,"data:legacy-new"]`, legacyExpireAt),
+			"data:legacy-key:0": `[1,"data","legacy-key:0"]`,
+		}
+		for k, v := range records {
+			if err = bt.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TestMigrateTTL 要在其他测试之前运行，之后的测试写满 bolt 时会按 LRU 淘汰这些旧对象
+func TestMigrateTTL(t *testing.T) {
+	if legacyChecked {
+		t.Skip("legacy records are migrated once per process")
+	}
+	legacyChecked = true
+	err := db.View(func(tx *bolt.Tx) error {
+		var bt, be = tx.Bucket(bTTL), tx.Bucket(bExpire)
+		if bt == nil || be == nil {
+			return fmt.Errorf("ttl buckets missing")
+		}
+		v := bt.Get([]byte("data:legacy-new"))
+		if len(v) != 8 || int64(binary.BigEndian.Uint64(v)) != legacyExpireAt {
+			return fmt.Errorf("ttl record not migrated: %q", v)
+		}
+		if be.Get(expireIndex(legacyExpireAt, []byte("data:legacy-new"))) == nil {
+			return fmt.Errorf("expire index missing")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Expire(); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		key  string
+		kept bool
+	}{
+		{"legacy-old:meta", false}, // 整个对象过期
+		{"legacy-old:0", false},
+		{"legacy-new:meta", true},
+		{"legacy-key:0", false}, // 单个 key 过期
+		{"legacy-key:1", true},
+	}
+	for _, tt := range tests {
+		if v, _ := Get([]byte("data"), []byte(tt.key)); (v != nil) != tt.kept {
+			t.Errorf("%s: kept = %v, want %v", tt.key, v != nil, tt.kept)
+		}
+	}
+}
+
+// openTestBackends 返回临时的 mem、fs 后端及共用的 bolt 后端，maxSize 为 mem、fs 的容量上限
+// bolt 的数据在各个测试间共享，测试应使用各自不同的对象标识
+func openTestBackends(t *testing.T, maxSize int64) map[string]Backend {
+	mem, err := openMem("", maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := openFS(t.TempDir(), maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hook = nil })
+	return map[string]Backend{"mem": mem, "fs": fs, "bolt": testBolt}
+}
+
+// expireNow 让对象立即过期而不清理，模拟过期后还未被 Expire 删除的对象
+func expireNow(t *testing.T, b Backend, obj string) {
+	switch b := b.(type) {
+	case *memBackend:
+		b.mu.Lock()
+		b.objects[obj].expire = 1
+		b.mu.Unlock()
+	case *fsBackend:
+		b.mu.Lock()
+		b.expires[obj] = 1
+		b.mu.Unlock()
+	case *boltBackend:
+		ttlKey := objectKey(b.bucket, []byte(obj))
+		info, _ := json.Marshal([]any{1, string(ttlKey)})
+		err := db.Update(func(tx *bolt.Tx) error {
+			return setTTL(tx, ttlKey, 1, info)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// evictNow 按容量淘汰的路径删除对象
+func evictNow(b Backend, obj string) error {
+	switch b := b.(type) {
+	case *memBackend:
+		return b.evictObject(obj)
+	case *fsBackend:
+		return b.evictObject(obj)
+	case *boltBackend:
+		return evictObject(string(objectKey(b.bucket, []byte(obj))))
+	}
+	return nil
+}
+
+func TestExpiredObjectRewrite(t *testing.T) {
+	var tests = []struct {
+		name  string
+		write func(b Backend) error // 对象过期后的第一次写入
+	}{
+		{"set", func(b Backend) error { return b.Set([]byte("obj:0"), []byte("new0")) }},
+		{"ttl", func(b Backend) error { return b.SetTTL([]byte("obj"), 60) }},
+	}
+	for _, tt := range tests {
+		for name, b := range openTestBackends(t, 0) {
+			if name == "bolt" { // bolt 中过期的对象在清理前仍可读取，重新验证后继续使用，不会重新探测
+				continue
+			}
+			for _, k := range []string{"obj:meta", "obj:0", "obj:1"} {
+				if err := b.Set([]byte(k), []byte("old")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := b.SetTTL([]byte("obj"), 60); err != nil {
+				t.Fatal(err)
+			}
+			expireNow(t, b, "obj")
+			if ok, _ := b.Has([]byte("obj:1")); ok {
+				t.Fatalf("%s/%s: expired object still visible", tt.name, name)
+			}
+			if err := tt.write(b); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Set([]byte("obj:meta"), []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+			if v, _ := b.Get([]byte("obj:1")); v != nil {
+				t.Fatalf("%s/%s: chunk of the expired version came back: %q", tt.name, name, v)
+			}
+			if v, _ := b.Get([]byte("obj:meta")); !bytes.Equal(v, []byte("new")) {
+				t.Fatalf("%s/%s: meta = %q", tt.name, name, v)
+			}
+		}
+	}
+}
+
+func TestBackend(t *testing.T) {
+	for name, b := range openTestBackends(t, 0) {
+		var entries = map[string]string{"backend-a:meta": "{}", "backend-a:0": "chunk0", "backend-a:1": "chunk1", "backend-b:0": "other"}
+		for k, v := range entries {
+			if err := b.Set([]byte(k), []byte(v)); err != nil {
+				t.Fatalf("%s: Set %s: %v", name, k, err)
+			}
+		}
+		if err := b.Set([]byte("backend-a:1"), []byte("chunk1-new")); err != nil {
+			t.Fatal(err)
+		}
+		entries["backend-a:1"] = "chunk1-new"
+		for k, v := range entries {
+			if got, err := b.Get([]byte(k)); err != nil || string(got) != v {
+				t.Fatalf("%s: Get %s = %q, %v, want %q", name, k, got, err, v)
+			}
+			if ok, err := b.Has([]byte(k)); err != nil || !ok {
+				t.Fatalf("%s: Has %s = %v, %v", name, k, ok, err)
+			}
+		}
+		if got, err := b.Get([]byte("backend-a:2")); got != nil || err != nil {
+			t.Fatalf("%s: Get missing = %q, %v", name, got, err)
+		}
+		if ok, _ := b.Has([]byte("backend-a:2")); ok {
+			t.Fatalf("%s: Has missing", name)
+		}
+		if err := b.Remove([]byte("backend-a")); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"backend-a:meta", "backend-a:0", "backend-a:1"} {
+			if ok, _ := b.Has([]byte(k)); ok {
+				t.Fatalf("%s: %s left after Remove", name, k)
+			}
+		}
+		if got, _ := b.Get([]byte("backend-b:0")); string(got) != "other" { // 只删除对象自己的 key
+			t.Fatalf("%s: Remove touched another object: %q", name, got)
+		}
+		if err := b.Remove([]byte("backend-b")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackendTTL(t *testing.T) {
+	var tests = []struct {
+		name   string
+		ttl    int64
+		expire bool // 是否在 Expire 之前让对象过期
+		kept   bool
+	}{
+		{"fresh", 60, false, true},
+		{"expired", 60, true, false},
+		{"forever", 0, false, true},
+	}
+	for _, tt := range tests {
+		for name, b := range openTestBackends(t, 0) {
+			var obj = "ttl-" + tt.name
+			if err := b.Remove([]byte(obj)); err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range []string{":meta", ":0"} {
+				if err := b.Set([]byte(obj+k), []byte("v")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := b.SetTTL([]byte(obj), tt.ttl); err != nil {
+				t.Fatal(err)
+			}
+			if tt.expire {
+				expireNow(t, b, obj)
+			}
+			if err := b.Expire(); err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range []string{":meta", ":0"} { // 元信息与分片一起过期
+				if ok, _ := b.Has([]byte(obj + k)); ok != tt.kept {
+					t.Fatalf("%s/%s: Has %s = %v, want %v", tt.name, name, k, ok, tt.kept)
+				}
+			}
+		}
+	}
+}
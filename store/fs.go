@@ -0,0 +1,324 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/suconghou/cachelayer/util"
+)
+
+const (
+	fsExpireFile = ".expire" // 对象目录下记录过期时间戳的文件，8 字节
+	fsTmpSuffix  = ".tmp"    // 写入中的临时文件后缀
+	fsTrashDir   = ".trash"
+)
+
+// fsBackend 每个分片存为一个文件，目录按对象标识分两级散列，如 root/ab/cd/abcd.../0
+// 同一对象的文件位于同一目录，过期或淘汰时先整体移入回收目录再删除，保证对象的删除是原子的
+type fsBackend struct {
+	root    string
+	cache   *lru
+	mu      sync.Mutex
+	expires map[string]int64    // 对象的过期时间戳，启动时从各对象目录的 .expire 文件恢复
+	touched map[string]struct{} // 有效期已在内存中延长但还未写入 .expire 文件的对象
+	hook    removeHook
+}
+
+func openFS(dsn string, maxSize int64) (Backend, error) {
+	f := &fsBackend{root: dsn, cache: newLRU(maxSize), expires: map[string]int64{}, touched: map[string]struct{}{}}
+	if err := os.MkdirAll(filepath.Join(dsn, fsTrashDir), 0755); err != nil {
+		return nil, err
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	f.cache.evict(f.removeObject)
+	go f.flushLoop()
+	return f, nil
+}
+
+func (f *fsBackend) dir(obj string) string {
+	obj = url.PathEscape(obj)
+	if len(obj) < 4 {
+		return filepath.Join(f.root, "_", "_", obj)
+	}
+	return filepath.Join(f.root, obj[0:2], obj[2:4], obj)
+}
+
+func (f *fsBackend) file(key []byte) (string, string) {
+	obj, name := splitKey(key)
+	return obj, filepath.Join(f.dir(obj), url.PathEscape(name))
+}
+
+func (f *fsBackend) expired(obj string, now int64) bool {
+	f.mu.Lock()
+	t := f.expires[obj]
+	f.mu.Unlock()
+	return t > 0 && t <= now
+}
+
+func (f *fsBackend) Get(key []byte) ([]byte, error) {
+	obj, file := f.file(key)
+	if f.expired(obj, time.Now().Unix()) {
+		return nil, nil
+	}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// Set 先写入临时文件再重命名，读取方不会读到写了一半的文件
+// 对象已过期但还未清理时先整体删除，新写入的数据不会与旧版本的分片混在一起
+func (f *fsBackend) Set(key, value []byte) error {
+	var (
+		obj, file = f.file(key)
+		delta     = int64(len(value))
+	)
+	if f.expired(obj, time.Now().Unix()) {
+		if err := f.removeObject(obj); err != nil {
+			return err
+		}
+	}
+	if fi, err := os.Stat(file); err == nil {
+		delta -= fi.Size()
+	}
+	if err := writeFile(file, value); err != nil {
+		return err
+	}
+	f.cache.add(obj, delta, time.Now().Unix())
+	f.cache.evict(f.evictObject)
+	return nil
+}
+
+func (f *fsBackend) Has(key []byte) (bool, error) {
+	var (
+		obj, file = f.file(key)
+		now       = time.Now().Unix()
+	)
+	if f.expired(obj, now) {
+		return false, nil
+	}
+	_, err := os.Stat(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	f.cache.touch(obj, now)
+	return true, nil
+}
+
+func (f *fsBackend) SetTTL(key []byte, ttl int64) error {
+	var (
+		obj, _ = splitKey(key)
+		t      int64
+	)
+	if f.expired(obj, time.Now().Unix()) {
+		if err := f.removeObject(obj); err != nil {
+			return err
+		}
+	}
+	if ttl > 0 {
+		t = time.Now().Unix() + ttl
+	}
+	f.mu.Lock()
+	f.expires[obj] = t
+	delete(f.touched, obj)
+	f.mu.Unlock()
+	return f.writeExpire(obj, t)
+}
+
+// Touch 只修改内存中的过期时间，由 flushLoop 定时写入 .expire 文件
+func (f *fsBackend) Touch(key []byte, ttl int64) {
+	var (
+		obj, _ = splitKey(key)
+		now    = time.Now().Unix()
+	)
+	f.cache.touch(obj, now)
+	if ttl <= 0 {
+		return
+	}
+	f.mu.Lock()
+	if t, ok := f.expires[obj]; ok && t > 0 {
+		f.expires[obj] = now + ttl
+		f.touched[obj] = struct{}{}
+	}
+	f.mu.Unlock()
+}
+
+func (f *fsBackend) flushLoop() {
+	for range time.Tick(touchInterval) {
+		f.mu.Lock()
+		var pending = make(map[string]int64, len(f.touched))
+		for obj := range f.touched {
+			pending[obj] = f.expires[obj]
+		}
+		f.touched = map[string]struct{}{}
+		f.mu.Unlock()
+		for obj, t := range pending {
+			if err := f.writeExpire(obj, t); err != nil {
+				util.Log.Print(err)
+			}
+		}
+	}
+}
+
+func (f *fsBackend) writeExpire(obj string, t int64) error {
+	var file = filepath.Join(f.dir(obj), fsExpireFile)
+	if t == 0 {
+		if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(t))
+	return writeFile(file, v)
+}
+
+func (f *fsBackend) Remove(key []byte) error {
+	obj, _ := splitKey(key)
+	return f.removeObject(obj)
+}
+
+// Expire 过期时间保存在内存中，只需遍历对象而无需遍历全部文件
+func (f *fsBackend) Expire() error {
+	var (
+		now     = time.Now().Unix()
+		expired []string
+	)
+	f.mu.Lock()
+	for obj, t := range f.expires {
+		if t > 0 && t <= now {
+			expired = append(expired, obj)
+		}
+	}
+	f.mu.Unlock()
+	err := f.hook.run(func() ([]string, error) {
+		var errs []error
+		for _, obj := range expired {
+			errs = append(errs, f.removeObject(obj))
+		}
+		return expired, errors.Join(errs...)
+	})
+	return errors.Join(err, f.emptyTrash())
+}
+
+func (f *fsBackend) setRemoveHook(h removeHook) {
+	f.hook = h
+}
+
+// evictObject 淘汰对象，经过 hook 以便写入队列丢弃对象排队中的写入
+func (f *fsBackend) evictObject(obj string) error {
+	return f.hook.run(func() ([]string, error) {
+		return []string{obj}, f.removeObject(obj)
+	})
+}
+
+// removeObject 将对象目录整体移入回收目录后再删除
+func (f *fsBackend) removeObject(obj string) error {
+	trash := filepath.Join(f.root, fsTrashDir, url.PathEscape(obj)+"."+strconv.FormatInt(time.Now().UnixNano(), 36))
+	err := os.Rename(f.dir(obj), trash)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	f.mu.Lock()
+	delete(f.expires, obj)
+	delete(f.touched, obj)
+	f.mu.Unlock()
+	f.cache.remove(obj)
+	if err != nil {
+		return nil
+	}
+	return os.RemoveAll(trash)
+}
+
+func (f *fsBackend) emptyTrash() error {
+	trash := filepath.Join(f.root, fsTrashDir)
+	entries, err := os.ReadDir(trash)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, e := range entries {
+		errs = append(errs, os.RemoveAll(filepath.Join(trash, e.Name())))
+	}
+	return errors.Join(errs...)
+}
+
+// load 启动时遍历目录重建 LRU 队列及过期时间，以文件的修改时间作为对象的最近访问时间，并清理残留的临时文件
+func (f *fsBackend) load() error {
+	if err := f.emptyTrash(); err != nil {
+		return err
+	}
+	var objects = map[string]*lruItem{}
+	err := filepath.WalkDir(f.root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(file, fsTmpSuffix) {
+			return os.Remove(file)
+		}
+		obj, err := url.PathUnescape(filepath.Base(filepath.Dir(file)))
+		if err != nil {
+			return nil
+		}
+		if d.Name() == fsExpireFile {
+			b, err := os.ReadFile(file)
+			if err == nil && len(b) == 8 {
+				f.expires[obj] = int64(binary.BigEndian.Uint64(b))
+			}
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		o, ok := objects[obj]
+		if !ok {
+			o = &lruItem{obj: obj}
+			objects[obj] = o
+		}
+		o.size += fi.Size()
+		o.atime = max(o.atime, fi.ModTime().Unix())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var items = make([]*lruItem, 0, len(objects))
+	for _, o := range objects {
+		items = append(items, o)
+	}
+	f.cache.load(items)
+	return nil
+}
+
+func writeFile(file string, value []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*"+fsTmpSuffix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(value)
+	if err = errors.Join(err, tmp.Close()); err != nil {
+		return errors.Join(err, os.Remove(tmp.Name()))
+	}
+	if err = os.Rename(tmp.Name(), file); err != nil {
+		return errors.Join(err, os.Remove(tmp.Name()))
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package store
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	"github.com/suconghou/cachelayer/util"
+)
+
+// lru 在内存中记录每个对象占用的字节数及最近访问顺序，淘汰时以对象为单位整体删除
+// 对象标识由各个后端决定，通常为 key 中第一个 ':' 之前的部分
+type lru struct {
+	mu       sync.Mutex
+	max      int64 // 容量上限(字节)，<=0 表示不限制
+	total    int64 // 当前所有对象占用的字节数
+	ll       *list.List
+	items    map[string]*list.Element
+	evicting bool
+}
+
+type lruItem struct {
+	obj   string
+	size  int64
+	atime int64
+}
+
+func newLRU(max int64) *lru {
+	return &lru{
+		max:   max,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+// set 更新对象的大小与访问时间，并移到最近使用的位置，size<=0 时移除该对象
+// atime 为 0 时只更新大小，不改变其在队列中的位置
+func (l *lru) set(obj string, size int64, atime int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.update(obj, size, atime)
+}
+
+func (l *lru) update(obj string, size int64, atime int64) {
+	e, ok := l.items[obj]
+	if size <= 0 {
+		if ok {
+			l.total -= e.Value.(*lruItem).size
+			l.ll.Remove(e)
+			delete(l.items, obj)
+		}
+		return
+	}
+	if !ok {
+		item := &lruItem{obj: obj, size: size, atime: atime}
+		if atime > 0 {
+			l.items[obj] = l.ll.PushFront(item)
+		} else {
+			l.items[obj] = l.ll.PushBack(item)
+		}
+		l.total += size
+		return
+	}
+	item := e.Value.(*lruItem)
+	l.total += size - item.size
+	item.size = size
+	if atime > 0 {
+		item.atime = atime
+		l.ll.MoveToFront(e)
+	}
+}
+
+// add 按增量调整对象的大小并刷新访问时间，用于不便获取对象总大小的后端
+func (l *lru) add(obj string, delta int64, atime int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var size = delta
+	if e, ok := l.items[obj]; ok {
+		size += e.Value.(*lruItem).size
+	}
+	l.update(obj, size, atime)
+}
+
+// touch 仅在内存中刷新对象的访问顺序
+func (l *lru) touch(obj string, atime int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[obj]; ok {
+		e.Value.(*lruItem).atime = atime
+		l.ll.MoveToFront(e)
+	}
+}
+
+// load 用于启动时恢复数据，按访问时间从旧到新依次放入队列
+func (l *lru) load(items []*lruItem) {
+	sort.Slice(items, func(i, j int) bool { return items[i].atime < items[j].atime })
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, item := range items {
+		if _, ok := l.items[item.obj]; ok || item.size <= 0 {
+			continue
+		}
+		l.items[item.obj] = l.ll.PushFront(item)
+		l.total += item.size
+	}
+}
+
+func (l *lru) remove(obj string) {
+	l.set(obj, 0, 0)
+}
+
+// needEvict 判断是否超出容量，若需要淘汰且当前没有淘汰任务，则标记为淘汰中并返回 true
+func (l *lru) needEvict() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max <= 0 || l.total <= l.max || l.evicting {
+		return false
+	}
+	l.evicting = true
+	return true
+}
+
+// victim 返回最久未访问的对象，淘汰到容量的 90% 以下为止，避免频繁触发
+func (l *lru) victim() (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.total <= l.max/10*9 {
+		l.evicting = false
+		return "", false
+	}
+	e := l.ll.Back()
+	if e == nil {
+		l.evicting = false
+		return "", false
+	}
+	return e.Value.(*lruItem).obj, true
+}
+
+// evict 超出容量时在后台按最近最少使用的顺序淘汰整个对象，同一时间只有一个淘汰任务
+func (l *lru) evict(remove func(obj string) error) {
+	if !l.needEvict() {
+		return
+	}
+	go func() {
+		for {
+			obj, ok := l.victim()
+			if !ok {
+				return
+			}
+			if err := remove(obj); err != nil {
+				util.Log.Print(err)
+				l.remove(obj) // 删除失败也移出队列，避免反复重试同一个对象
+			}
+		}
+	}()
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// lruOf 返回后端的 LRU 队列及对象在其中的标识
+func lruOf(b Backend, obj string) (*lru, string) {
+	switch b := b.(type) {
+	case *memBackend:
+		return b.cache, obj
+	case *fsBackend:
+		return b.cache, obj
+	case *boltBackend:
+		return cache, string(objectKey(b.bucket, []byte(obj)))
+	}
+	return nil, ""
+}
+
+// lruSize 返回对象在 LRU 中记录的大小，不在队列中时返回 -1
+func lruSize(b Backend, obj string) int64 {
+	l, key := lruOf(b, obj)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		return e.Value.(*lruItem).size
+	}
+	return -1
+}
+
+func TestLRUAccounting(t *testing.T) {
+	var tests = []struct {
+		name  string
+		write func(b Backend, obj string) error
+		size  int64
+	}{
+		{"set", func(b Backend, obj string) error { return b.Set([]byte(obj+":0"), make([]byte, 100)) }, 100},
+		{"two keys", func(b Backend, obj string) error {
+			return errors.Join(b.Set([]byte(obj+":0"), make([]byte, 100)), b.Set([]byte(obj+":1"), make([]byte, 50)))
+		}, 150},
+		{"overwrite", func(b Backend, obj string) error {
+			return errors.Join(b.Set([]byte(obj+":0"), make([]byte, 100)), b.Set([]byte(obj+":0"), make([]byte, 30)))
+		}, 30},
+		{"remove", func(b Backend, obj string) error {
+			return errors.Join(b.Set([]byte(obj+":0"), make([]byte, 100)), b.Remove([]byte(obj)))
+		}, -1},
+	}
+	for _, tt := range tests {
+		for name, b := range openTestBackends(t, 0) {
+			var obj = "lru-" + tt.name
+			if err := b.Remove([]byte(obj)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.write(b, obj); err != nil {
+				t.Fatal(err)
+			}
+			if got := lruSize(b, obj); got != tt.size {
+				t.Fatalf("%s/%s: size = %d, want %d", tt.name, name, got, tt.size)
+			}
+		}
+	}
+}
+
+func TestLRUEvict(t *testing.T) {
+	for name, b := range openTestBackends(t, 1000) {
+		var size = 400
+		if name == "bolt" {
+			size = testBoltSize * 4 / 10
+		}
+		for _, obj := range []string{"evict-a", "evict-b"} {
+			if err := b.Set([]byte(obj+":0"), bytes.Repeat([]byte("x"), size)); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if ok, _ := b.Has([]byte("evict-a:0")); !ok { // 访问后 a 比 b 新
+			t.Fatalf("%s: evict-a missing", name)
+		}
+		if err := b.Set([]byte("evict-c:0"), bytes.Repeat([]byte("x"), size)); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); lruSize(b, "evict-b") >= 0; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: least recently used object not evicted", name)
+			}
+		}
+		if ok, _ := b.Has([]byte("evict-b:0")); ok {
+			t.Fatalf("%s: evicted object still readable", name)
+		}
+		for _, obj := range []string{"evict-a", "evict-c"} {
+			if ok, _ := b.Has([]byte(obj + ":0")); !ok {
+				t.Fatalf("%s: %s evicted", name, obj)
+			}
+			if err := b.Remove([]byte(obj)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestFSReload(t *testing.T) {
+	var dir = t.TempDir()
+	b, err := openFS(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = errors.Join(b.Set([]byte("reload:0"), make([]byte, 100)), b.Set([]byte("reload:1"), make([]byte, 20)), b.SetTTL([]byte("reload"), 60)); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := openFS(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lruSize(reopened, "reload"); got != 120 {
+		t.Fatalf("size after reload = %d, want 120", got)
+	}
+	if f := reopened.(*fsBackend); f.expires["reload"] <= time.Now().Unix() {
+		t.Fatalf("expire time after reload = %d", f.expires["reload"])
+	}
+	expireNow(t, reopened, "reload")
+	if err = reopened.Expire(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := reopened.Has([]byte("reload:0")); ok {
+		t.Fatal("expired object still readable after reload")
+	}
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// memBackend 将数据保存在进程内存中，重启后数据丢失，适合小容量或测试场景
+type memBackend struct {
+	mu      sync.RWMutex
+	objects map[string]*memObject
+	cache   *lru
+	hook    removeHook
+}
+
+type memObject struct {
+	entries map[string][]byte
+	size    int64
+	expire  int64 // 过期时间戳，0 表示永不过期
+}
+
+func (o *memObject) expired(now int64) bool {
+	return o.expire > 0 && o.expire <= now
+}
+
+func openMem(_ string, maxSize int64) (Backend, error) {
+	return &memBackend{
+		objects: map[string]*memObject{},
+		cache:   newLRU(maxSize),
+	}, nil
+}
+
+func (m *memBackend) Get(key []byte) ([]byte, error) {
+	obj, name := splitKey(key)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, ok := m.objects[obj]
+	if !ok || o.expired(time.Now().Unix()) {
+		return nil, nil
+	}
+	v, ok := o.entries[name]
+	if !ok {
+		return nil, nil
+	}
+	value := make([]byte, len(v))
+	copy(value, v)
+	return value, nil
+}
+
+func (m *memBackend) Set(key, value []byte) error {
+	var (
+		obj, name = splitKey(key)
+		now       = time.Now().Unix()
+		v         = make([]byte, len(value))
+		size      int64
+	)
+	copy(v, value)
+	m.mu.Lock()
+	o, ok := m.objects[obj]
+	if !ok || o.expired(now) { // 已过期还未清理的对象整体丢弃，新写入的数据不会与旧版本的分片混在一起
+		o = &memObject{entries: map[string][]byte{}}
+		m.objects[obj] = o
+	}
+	if old, ok := o.entries[name]; ok {
+		o.size -= int64(len(old))
+	}
+	o.entries[name] = v
+	o.size += int64(len(v))
+	size = o.size
+	m.mu.Unlock()
+	m.cache.set(obj, size, now)
+	m.cache.evict(m.evictObject)
+	return nil
+}
+
+func (m *memBackend) Has(key []byte) (bool, error) {
+	var (
+		obj, name = splitKey(key)
+		now       = time.Now().Unix()
+		ok        = false
+	)
+	m.mu.RLock()
+	if o, found := m.objects[obj]; found && !o.expired(now) {
+		_, ok = o.entries[name]
+	}
+	m.mu.RUnlock()
+	if ok {
+		m.cache.touch(obj, now)
+	}
+	return ok, nil
+}
+
+func (m *memBackend) SetTTL(key []byte, ttl int64) error {
+	var (
+		obj, _ = splitKey(key)
+		now    = time.Now().Unix()
+	)
+	m.mu.Lock()
+	o, ok := m.objects[obj]
+	if ok && o.expired(now) { // 同 Set，不能让旧版本的分片随新的有效期复活
+		ok = false
+		m.cache.remove(obj)
+	}
+	if !ok {
+		o = &memObject{entries: map[string][]byte{}}
+		m.objects[obj] = o
+	}
+	o.expire = 0
+	if ttl > 0 {
+		o.expire = now + ttl
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memBackend) Touch(key []byte, ttl int64) {
+	obj, _ := splitKey(key)
+	m.cache.touch(obj, time.Now().Unix())
+	if ttl <= 0 {
+		return
+	}
+	m.mu.Lock()
+	if o, ok := m.objects[obj]; ok && o.expire > 0 {
+		o.expire = time.Now().Unix() + ttl
+	}
+	m.mu.Unlock()
+}
+
+func (m *memBackend) Remove(key []byte) error {
+	obj, _ := splitKey(key)
+	return m.removeObject(obj)
+}
+
+func (m *memBackend) Expire() error {
+	return m.hook.run(func() ([]string, error) {
+		var (
+			now     = time.Now().Unix()
+			expired []string
+		)
+		m.mu.Lock()
+		for obj, o := range m.objects {
+			if o.expired(now) {
+				delete(m.objects, obj)
+				expired = append(expired, obj)
+			}
+		}
+		m.mu.Unlock()
+		for _, obj := range expired {
+			m.cache.remove(obj)
+		}
+		return expired, nil
+	})
+}
+
+func (m *memBackend) setRemoveHook(h removeHook) {
+	m.hook = h
+}
+
+// evictObject 淘汰对象，经过 hook 以便写入队列丢弃对象排队中的写入
+func (m *memBackend) evictObject(obj string) error {
+	return m.hook.run(func() ([]string, error) {
+		return []string{obj}, m.removeObject(obj)
+	})
+}
+
+func (m *memBackend) removeObject(obj string) error {
+	m.mu.Lock()
+	delete(m.objects, obj)
+	m.mu.Unlock()
+	m.cache.remove(obj)
+	return nil
+}
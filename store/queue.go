@@ -0,0 +1,219 @@
+package store
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/suconghou/cachelayer/util"
+)
+
+// queueGroupSize 后台写入时每组最多合并的条目数
+const queueGroupSize = 64
+
+// batchSetter 由支持在一个事务中写入多条数据的后端实现
+type batchSetter interface {
+	SetBatch(keys, values [][]byte) error
+}
+
+// ErrQueueFull 表示写入队列已满，分片被丢弃而没有写入
+var ErrQueueFull = errors.New("write queue full")
+
+type queueItem struct {
+	key     []byte
+	value   []byte
+	removed bool // 写入前已被新条目覆盖或所属对象已被删除，写入时跳过
+}
+
+// writeBehind 为后端包装一个按字节数限制的写入队列，分片的 Set 只入队立即返回，由后台协程分组写入
+// 队列满时丢弃分片并返回 ErrQueueFull，不阻塞调用方；元信息总是同步写入，不会被丢弃
+// 尚未写入的数据保存在 pending 中，Get/Has 可以立即读到
+type writeBehind struct {
+	Backend
+	mu      sync.RWMutex
+	pending map[string]*queueItem
+	queue   []*queueItem // 等待写入的条目
+	size    int64        // 队列中条目的总字节数
+	limit   int64
+	wake    chan struct{}
+	wmu     sync.Mutex // 串行化写入与 Remove，保证对象删除后不会再写入排队中的旧数据
+	dropped atomic.Int64
+}
+
+// WriteBehind 返回带写入队列的后端，limit 为队列中数据的字节数上限，limit<=0 时原样返回
+func WriteBehind(b Backend, limit int64) Backend {
+	if limit <= 0 {
+		return b
+	}
+	w := &writeBehind{
+		Backend: b,
+		pending: map[string]*queueItem{},
+		limit:   limit,
+		wake:    make(chan struct{}, 1),
+	}
+	if h, ok := b.(removeHooker); ok {
+		h.setRemoveHook(w.removing)
+	}
+	go w.loop()
+	return w
+}
+
+func (w *writeBehind) Set(key, value []byte) error {
+	if _, name := splitKey(key); name == "meta" { // 元信息决定对象是否存在，不能丢弃
+		w.wmu.Lock()
+		defer w.wmu.Unlock()
+		return w.Backend.Set(key, value)
+	}
+	item := &queueItem{key: append([]byte{}, key...), value: append([]byte{}, value...)}
+	w.mu.Lock()
+	if w.size+int64(len(item.value)) > w.limit {
+		w.mu.Unlock()
+		if n := w.dropped.Add(1); n&(n-1) == 0 { // 按 2 的幂次打印，避免刷屏
+			util.Log.Printf("write queue full, %d writes dropped", n)
+		}
+		return ErrQueueFull
+	}
+	if old, ok := w.pending[string(item.key)]; ok { // 被覆盖的旧条目无需再写入
+		old.removed = true
+	}
+	w.pending[string(item.key)] = item
+	w.queue = append(w.queue, item)
+	w.size += int64(len(item.value))
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (w *writeBehind) Get(key []byte) ([]byte, error) {
+	w.mu.RLock()
+	item, ok := w.pending[string(key)]
+	w.mu.RUnlock()
+	if ok {
+		return append([]byte{}, item.value...), nil
+	}
+	return w.Backend.Get(key)
+}
+
+func (w *writeBehind) Has(key []byte) (bool, error) {
+	w.mu.RLock()
+	_, ok := w.pending[string(key)]
+	w.mu.RUnlock()
+	if ok {
+		return true, nil
+	}
+	return w.Backend.Has(key)
+}
+
+// Remove 丢弃对象所有排队中的写入，再从后端删除对象
+func (w *writeBehind) Remove(key []byte) error {
+	obj, _ := splitKey(key)
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	w.purge(obj)
+	return w.Backend.Remove(key)
+}
+
+// removing 是后端自行删除对象（过期、容量淘汰）时经过的 hook，删除期间不写入，删除后丢弃这些对象排队中的写入，
+// 已删除的对象不会再被写入没有元信息也没有有效期的分片
+func (w *writeBehind) removing(remove func() ([]string, error)) error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	objs, err := remove()
+	for _, obj := range objs {
+		w.purge(obj)
+	}
+	return err
+}
+
+// purge 丢弃对象所有排队中的写入，调用方持有 wmu
+func (w *writeBehind) purge(obj string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for k, item := range w.pending {
+		if o, _ := splitKey(item.key); o == obj {
+			item.removed = true
+			delete(w.pending, k)
+		}
+	}
+}
+
+// Dropped 返回因队列已满被丢弃的写入次数
+func (w *writeBehind) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+// done 将已写入或被跳过的条目移出 pending 并释放其占用的队列空间，同一个 key 被再次写入时保留新的条目
+func (w *writeBehind) done(item *queueItem) {
+	w.mu.Lock()
+	if w.pending[string(item.key)] == item {
+		delete(w.pending, string(item.key))
+	}
+	w.size -= int64(len(item.value))
+	w.mu.Unlock()
+}
+
+// next 取出队列头部最多 queueGroupSize 个条目
+func (w *writeBehind) next() []*queueItem {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := min(len(w.queue), queueGroupSize)
+	items := slices.Clone(w.queue[:n])
+	clear(w.queue[:n]) // 不再引用已取出的条目，写入后即可回收
+	w.queue = w.queue[n:]
+	if len(w.queue) == 0 {
+		w.queue = nil
+	}
+	return items
+}
+
+func (w *writeBehind) loop() {
+	for range w.wake {
+		w.flush()
+	}
+}
+
+// flush 分组写入队列中的全部条目
+func (w *writeBehind) flush() {
+	for items := w.next(); len(items) > 0; items = w.next() {
+		if err := w.write(items); err != nil {
+			util.Log.Print(err)
+		}
+		for _, item := range items {
+			w.done(item)
+		}
+	}
+}
+
+func (w *writeBehind) write(items []*queueItem) error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	w.mu.RLock()
+	var valid = items[:0:0]
+	for _, item := range items {
+		if !item.removed {
+			valid = append(valid, item)
+		}
+	}
+	w.mu.RUnlock()
+	items = valid
+	if len(items) == 0 {
+		return nil
+	}
+	if bs, ok := w.Backend.(batchSetter); ok {
+		var keys, values = make([][]byte, len(items)), make([][]byte, len(items))
+		for i, item := range items {
+			keys[i], values[i] = item.key, item.value
+		}
+		return bs.SetBatch(keys, values)
+	}
+	for _, item := range items {
+		if err := w.Backend.Set(item.key, item.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTestQueue 返回不启动后台协程的写入队列，由测试调用 flush 控制写入时机
+func newTestQueue(b Backend) *writeBehind {
+	w := &writeBehind{
+		Backend: b,
+		pending: map[string]*queueItem{},
+		limit:   1 << 20,
+		wake:    make(chan struct{}, 1),
+	}
+	if h, ok := b.(removeHooker); ok {
+		h.setRemoveHook(w.removing)
+	}
+	return w
+}
+
+func TestQueueDropsRemovedObjects(t *testing.T) {
+	var tests = []struct {
+		name   string
+		remove func(t *testing.T, w *writeBehind, obj string) error // 分片排队期间删除对象
+		stored bool
+	}{
+		{"kept", func(t *testing.T, w *writeBehind, obj string) error { return nil }, true},
+		{"remove", func(t *testing.T, w *writeBehind, obj string) error { return w.Remove([]byte(obj)) }, false},
+		{"expire", func(t *testing.T, w *writeBehind, obj string) error {
+			expireNow(t, w.Backend, obj)
+			return w.Expire()
+		}, false},
+		{"evict", func(t *testing.T, w *writeBehind, obj string) error { return evictNow(w.Backend, obj) }, false},
+	}
+	for _, tt := range tests {
+		for name, b := range openTestBackends(t, 0) {
+			var (
+				w   = newTestQueue(b)
+				obj = "queue-" + tt.name
+			)
+			if err := b.Remove([]byte(obj)); err != nil { // bolt 的数据在各次测试间共享
+				t.Fatal(err)
+			}
+			if err := w.Set([]byte(obj+":meta"), []byte("{}")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.SetTTL([]byte(obj), 60); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Set([]byte(obj+":0"), []byte("chunk")); err != nil {
+				t.Fatal(err)
+			}
+			if v, _ := b.Get([]byte(obj + ":meta")); !bytes.Equal(v, []byte("{}")) { // 元信息同步写入
+				t.Fatalf("%s/%s: meta not written synchronously", tt.name, name)
+			}
+			if ok, _ := b.Has([]byte(obj + ":0")); ok {
+				t.Fatalf("%s/%s: chunk written before flush", tt.name, name)
+			}
+			if ok, _ := w.Has([]byte(obj + ":0")); !ok {
+				t.Fatalf("%s/%s: queued chunk not visible", tt.name, name)
+			}
+			if err := tt.remove(t, w, obj); err != nil {
+				t.Fatal(err)
+			}
+			w.flush()
+			if ok, _ := b.Has([]byte(obj + ":0")); ok != tt.stored {
+				t.Fatalf("%s/%s: chunk stored = %v, want %v", tt.name, name, ok, tt.stored)
+			}
+			if w.size != 0 || len(w.pending) != 0 {
+				t.Fatalf("%s/%s: queue not drained: %d bytes, %d pending", tt.name, name, w.size, len(w.pending))
+			}
+		}
+	}
+}
+
+func TestQueueLimit(t *testing.T) {
+	var w = newTestQueue(openTestBackends(t, 0)["mem"])
+	w.limit = 10
+	var tests = []struct {
+		key   string
+		value string
+		err   error
+	}{
+		{"a:0", "12345", nil},
+		{"a:1", "123456", ErrQueueFull},
+		{"a:meta", "0123456789abcdef", nil}, // 元信息不进入队列，不受限制
+		{"a:0", "1234", nil},                // 覆盖排队中的旧条目
+		{"a:2", "1", nil},
+	}
+	for _, tt := range tests {
+		if err := w.Set([]byte(tt.key), []byte(tt.value)); err != tt.err {
+			t.Fatalf("Set(%s, %d bytes) error = %v, want %v", tt.key, len(tt.value), err, tt.err)
+		}
+	}
+	if w.Dropped() != 1 {
+		t.Fatalf("Dropped = %d", w.Dropped())
+	}
+	w.flush()
+	for _, tt := range []struct{ key, want string }{{"a:0", "1234"}, {"a:1", ""}, {"a:2", "1"}} {
+		if v, _ := w.Get([]byte(tt.key)); string(v) != tt.want {
+			t.Fatalf("Get(%s) = %q, want %q", tt.key, v, tt.want)
+		}
+	}
+	if w.size != 0 {
+		t.Fatalf("queue size after flush = %d", w.size)
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	for name, b := range openTestBackends(t, 0) {
+		if WriteBehind(b, 0) != b {
+			t.Fatalf("%s: limit 0 should return the backend itself", name)
+		}
+		var (
+			w = WriteBehind(b, 1<<20)
+			n = queueGroupSize*2 + 1 // 分多组写入，bolt 每组一个事务
+		)
+		if err := w.Remove([]byte("behind")); err != nil {
+			t.Fatal(err)
+		}
+		for i := range n {
+			if err := w.Set(fmt.Appendf(nil, "behind:%d", i), fmt.Appendf(nil, "chunk%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := range n {
+			var key = fmt.Appendf(nil, "behind:%d", i)
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+				if v, _ := b.Get(key); string(v) == fmt.Sprintf("chunk%d", i) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%s: %s never written", name, key)
+				}
+			}
+		}
+		if err := w.Remove([]byte("behind")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -2,34 +2,119 @@ package store
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
-	"errors"
 	"time"
 
-	"github.com/tidwall/gjson"
 	bolt "go.etcd.io/bbolt"
 	dberr "go.etcd.io/bbolt/errors"
 )
 
 var (
-	db   *bolt.DB
-	bTTL = []byte("ttl")
+	db      *bolt.DB
+	cache   *lru
+	bTTL    = []byte("ttl")    // key -> 8 字节过期时间，用于找到 key 在 expire 中的索引
+	bExpire = []byte("expire") // 8 字节过期时间 + key -> 数据所在位置，按过期时间有序
+	bLRU    = []byte("lru")
+	hook    removeHook // 过期及容量淘汰时经过的 hook，由写入队列设置
 )
 
 // Init create db file or init , with ttl
-func Init(dbfile string) error {
+// maxSize 为缓存容量上限(字节)，超出后按最近最少使用淘汰整个对象，<=0 表示不限制
+func Init(dbfile string, maxSize int64) error {
 	var err error
 	db, err = bolt.Open(dbfile, 0666, &bolt.Options{Timeout: 1 * time.Second})
-	return err
+	if err != nil {
+		return err
+	}
+	if err = migrateTTL(); err != nil {
+		return err
+	}
+	cache = newLRU(maxSize)
+	if err = loadLRU(); err != nil {
+		return err
+	}
+	cache.evict(evictObject)
+	go flushLoop()
+	return nil
 }
 
+// Set 写入数据，同时计入所属对象的占用大小，超出容量时触发淘汰
 func Set(b1, key, value []byte) error {
-	return db.Update(func(tx *bolt.Tx) error {
+	var (
+		now  = time.Now().Unix()
+		obj  = objectKey(b1, key)
+		size int64
+	)
+	err := db.Update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists(b1)
 		if err != nil {
 			return err
 		}
-		return b.Put(key, value)
+		delta := int64(len(value) - len(b.Get(key)))
+		if err = b.Put(key, value); err != nil {
+			return err
+		}
+		size, err = account(tx, obj, delta, now)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	cache.set(string(obj), size, now)
+	cache.evict(evictObject)
+	return nil
+}
+
+// SetBatch 在一个事务中写入多条数据
+func SetBatch(b1 []byte, keys, values [][]byte) error {
+	var (
+		now   = time.Now().Unix()
+		sizes = map[string]int64{}
+	)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(b1)
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			delta := int64(len(values[i]) - len(b.Get(key)))
+			if err = b.Put(key, values[i]); err != nil {
+				return err
+			}
+			obj := objectKey(b1, key)
+			if sizes[string(obj)], err = account(tx, obj, delta, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for obj, size := range sizes {
+		cache.set(obj, size, now)
+	}
+	cache.evict(evictObject)
+	return nil
+}
+
+// TTLObject 设置整个对象的有效期，obj 为 key 中 ':' 之前的前缀，到期后对象的全部 key 在同一事务中删除
+// ttl<=0 时移除对象的有效期，对象不再过期
+func TTLObject(b1, obj []byte, ttl int64) error {
+	var ttlKey = objectKey(b1, obj)
+	if ttl <= 0 {
+		return db.Update(func(tx *bolt.Tx) error {
+			return delTTL(tx, ttlKey)
+		})
+	}
+	expireAt := time.Now().Unix() + ttl
+	tt, err := json.Marshal([]any{expireAt, string(ttlKey)})
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return setTTL(tx, ttlKey, expireAt, tt)
 	})
 }
 
@@ -47,41 +132,60 @@ func Set2(b1, b2, key, value []byte) error {
 	})
 }
 
+// TTLSet 写入数据并设置有效期，同时计入所属对象的占用大小，超出容量时触发淘汰
 func TTLSet(b1, key, value []byte, ttl int64) error {
+	var (
+		now  = time.Now().Unix()
+		obj  = objectKey(b1, key)
+		size int64
+	)
 	if ttl <= 0 {
-		return db.Update(func(tx *bolt.Tx) error {
+		err := db.Update(func(tx *bolt.Tx) error {
 			b, err := tx.CreateBucketIfNotExists(b1)
 			if err != nil {
 				return err
 			}
+			delta := int64(len(value) - len(b.Get(key)))
 			if err = b.Put(key, value); err != nil {
 				return err
 			}
-			bb := tx.Bucket(bTTL)
-			if bb == nil {
-				return nil
+			if size, err = account(tx, obj, delta, now); err != nil {
+				return err
 			}
-			return bb.Delete(bytes.Join([][]byte{b1, key}, []byte(":")))
+			return delTTL(tx, bytes.Join([][]byte{b1, key}, []byte(":")))
 		})
+		if err != nil {
+			return err
+		}
+		cache.set(string(obj), size, now)
+		cache.evict(evictObject)
+		return nil
 	}
-	tt, err := json.Marshal([]any{time.Now().Unix() + ttl, string(b1), string(key)})
+	tt, err := json.Marshal([]any{now + ttl, string(b1), string(key)})
 	if err != nil {
 		return err
 	}
-	return db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(bTTL)
-		if err != nil {
-			return err
-		}
-		if err = b.Put(bytes.Join([][]byte{b1, key}, []byte(":")), tt); err != nil {
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := setTTL(tx, bytes.Join([][]byte{b1, key}, []byte(":")), now+ttl, tt); err != nil {
 			return err
 		}
 		bb, err := tx.CreateBucketIfNotExists(b1)
 		if err != nil {
 			return err
 		}
-		return bb.Put(key, value)
+		delta := int64(len(value) - len(bb.Get(key)))
+		if err = bb.Put(key, value); err != nil {
+			return err
+		}
+		size, err = account(tx, obj, delta, now)
+		return err
 	})
+	if err != nil {
+		return err
+	}
+	cache.set(string(obj), size, now)
+	cache.evict(evictObject)
+	return nil
 }
 
 func TTLSet2(b1, b2, key, value []byte, ttl int64) error {
@@ -98,23 +202,16 @@ func TTLSet2(b1, b2, key, value []byte, ttl int64) error {
 			if err = bb.Put(key, value); err != nil {
 				return err
 			}
-			bbb := tx.Bucket(bTTL)
-			if bbb == nil {
-				return nil
-			}
-			return bbb.Delete(bytes.Join([][]byte{b1, b2, key}, []byte(":")))
+			return delTTL(tx, bytes.Join([][]byte{b1, b2, key}, []byte(":")))
 		})
 	}
-	tt, err := json.Marshal([]any{time.Now().Unix() + ttl, string(b1), string(b2), string(key)})
+	expireAt := time.Now().Unix() + ttl
+	tt, err := json.Marshal([]any{expireAt, string(b1), string(b2), string(key)})
 	if err != nil {
 		return err
 	}
 	return db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(bTTL)
-		if err != nil {
-			return err
-		}
-		if err = b.Put(bytes.Join([][]byte{b1, b2, key}, []byte(":")), tt); err != nil {
+		if err := setTTL(tx, bytes.Join([][]byte{b1, b2, key}, []byte(":")), expireAt, tt); err != nil {
 			return err
 		}
 		bb, err := tx.CreateBucketIfNotExists(b1)
@@ -197,12 +294,21 @@ func Exists2(b1, b2, key []byte) (bool, error) {
 
 // Touch 检查一个 key 是否存在。如果存在且 ttl > 0，则更新其有效期。
 // 如果 ttl <= 0，则该函数行为等同于 Exists，是一个只读操作。
+// 存在的 key 同时会刷新所属对象的最近访问时间，用于 LRU 淘汰。
 func Touch(b1, key []byte, ttl int64) (bool, error) {
+	var (
+		now = time.Now().Unix()
+		obj = objectKey(b1, key)
+	)
 	if ttl <= 0 {
-		return Exists(b1, key)
+		exist, err := Exists(b1, key)
+		if exist {
+			cache.touch(string(obj), now)
+		}
+		return exist, err
 	}
 	var exist = false
-	tt, err := json.Marshal([]any{time.Now().Unix() + ttl, string(b1), string(key)})
+	tt, err := json.Marshal([]any{now + ttl, string(b1), string(key)})
 	if err != nil {
 		return exist, err
 	}
@@ -213,12 +319,15 @@ func Touch(b1, key []byte, ttl int64) (bool, error) {
 		if !exist {
 			return nil
 		}
-		bt, err := tx.CreateBucketIfNotExists(bTTL)
-		if err != nil {
+		if err := setTTL(tx, bytes.Join([][]byte{b1, key}, []byte(":")), now+ttl, tt); err != nil {
 			return err
 		}
-		return bt.Put(bytes.Join([][]byte{b1, key}, []byte(":")), tt)
+		_, err = account(tx, obj, 0, now)
+		return err
 	})
+	if exist && err == nil {
+		cache.touch(string(obj), now)
+	}
 	return exist, err
 }
 
@@ -226,8 +335,11 @@ func Touch2(b1, b2, key []byte, ttl int64) (bool, error) {
 	if ttl <= 0 {
 		return Exists2(b1, b2, key)
 	}
-	var exist = false
-	tt, err := json.Marshal([]any{time.Now().Unix() + ttl, string(b1), string(b2), string(key)})
+	var (
+		exist    = false
+		expireAt = time.Now().Unix() + ttl
+	)
+	tt, err := json.Marshal([]any{expireAt, string(b1), string(b2), string(key)})
 	if err != nil {
 		return exist, err
 	}
@@ -240,35 +352,64 @@ func Touch2(b1, b2, key []byte, ttl int64) (bool, error) {
 		if !exist {
 			return nil
 		}
-		bt, err := tx.CreateBucketIfNotExists(bTTL)
-		if err != nil {
-			return err
-		}
-		return bt.Put(bytes.Join([][]byte{b1, b2, key}, []byte(":")), tt)
+		return setTTL(tx, bytes.Join([][]byte{b1, b2, key}, []byte(":")), expireAt, tt)
 	})
 	return exist, err
 }
 
 func Del(b1 []byte, keys [][]byte) error {
-	return db.Update(func(tx *bolt.Tx) error {
+	var sizes = map[string]int64{}
+	err := db.Update(func(tx *bolt.Tx) error {
 		if keys == nil {
 			err := tx.DeleteBucket(b1)
 			if err == dberr.ErrBucketNotFound {
-				err = nil
+				return nil
 			}
-			return err
+			if err != nil {
+				return err
+			}
+			// 整个 bucket 被删除，其下所有对象的 lru 记录一并移除
+			if bl := tx.Bucket(bLRU); bl != nil {
+				prefix := append(append([]byte{}, b1...), ':')
+				c := bl.Cursor()
+				for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+					sizes[string(k)] = 0
+					if err = c.Delete(); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
 		}
 		b := tx.Bucket(b1)
 		if b == nil {
 			return nil
 		}
 		for _, key := range keys {
+			v := b.Get(key)
+			if v == nil {
+				continue
+			}
+			delta := -int64(len(v))
 			if err := b.Delete(key); err != nil {
 				return err
 			}
+			obj := objectKey(b1, key)
+			size, err := account(tx, obj, delta, 0)
+			if err != nil {
+				return err
+			}
+			sizes[string(obj)] = size
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	for obj, size := range sizes {
+		cache.set(obj, size, 0)
+	}
+	return nil
 }
 
 func Del2(b1, b2 []byte, keys [][]byte) error {
@@ -344,63 +485,158 @@ func CheckForEachSet(b1 []byte, fn func(k1, v1 []byte) error, key, value []byte)
 	})
 }
 
-func Expire() error {
+// objectKey 返回 key 所属对象的标识 "bucket:key前缀"，如 data:<md5>:0 与 data:<md5>:meta 同属对象 data:<md5>
+func objectKey(b1, key []byte) []byte {
+	if i := bytes.IndexByte(key, ':'); i >= 0 {
+		key = key[:i]
+	}
+	return bytes.Join([][]byte{b1, key}, []byte(":"))
+}
+
+// lru bucket 中的值为 8 字节访问时间 + 8 字节对象大小
+func lruValue(atime, size int64) []byte {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v, uint64(atime))
+	binary.BigEndian.PutUint64(v[8:], uint64(size))
+	return v
+}
+
+func parseLRUValue(v []byte) (int64, int64, bool) {
+	if len(v) != 16 {
+		return 0, 0, false
+	}
+	return int64(binary.BigEndian.Uint64(v)), int64(binary.BigEndian.Uint64(v[8:])), true
+}
+
+// account 在同一事务中累加对象占用的字节数并刷新访问时间(atime 为 0 时保留原值)，返回更新后的对象大小
+func account(tx *bolt.Tx, obj []byte, delta int64, atime int64) (int64, error) {
+	b, err := tx.CreateBucketIfNotExists(bLRU)
+	if err != nil {
+		return 0, err
+	}
+	t, size, _ := parseLRUValue(b.Get(obj))
+	size += delta
+	if size <= 0 {
+		return 0, b.Delete(obj)
+	}
+	if atime > 0 {
+		t = atime
+	}
+	return size, b.Put(obj, lruValue(t, size))
+}
+
+// loadLRU 启动时从 lru bucket 恢复内存中的 LRU 队列，旧版本数据没有 lru 记录时扫描全部 bucket 重建
+func loadLRU() error {
+	var (
+		rebuild = false
+		items   []*lruItem
+	)
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bLRU)
+		if b == nil {
+			rebuild = true
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if atime, size, ok := parseLRUValue(v); ok {
+				items = append(items, &lruItem{obj: string(k), size: size, atime: atime})
+			}
+			return nil
+		})
+	})
+	if err != nil || !rebuild {
+		cache.load(items)
+		return err
+	}
 	var (
-		t               = time.Now().Unix()
-		ttlKeysToDelete = [][]byte{}
-		expiredDataInfo = make([][]gjson.Result, 0)
-		addKeys         = func(k []byte) {
-			key := make([]byte, len(k))
-			copy(key, k)
-			ttlKeysToDelete = append(ttlKeysToDelete, key)
-		}
-		iterate = func(k, v []byte) error {
-			j := gjson.ParseBytes(v).Array()
-			l := len(j)
-			if l < 3 || l > 4 {
-				// 不合法的数据，删除这个键值
-				addKeys(k)
+		now   = time.Now().Unix()
+		sizes = map[string]int64{}
+	)
+	err = db.Update(func(tx *bolt.Tx) error {
+		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if bytes.Equal(name, bTTL) || bytes.Equal(name, bExpire) || bytes.Equal(name, bLRU) {
 				return nil
 			}
-			if j[0].Int() > t {
+			return b.ForEach(func(k, v []byte) error {
+				if v != nil {
+					sizes[string(objectKey(name, k))] += int64(len(v))
+				}
 				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists(bLRU)
+		if err != nil {
+			return err
+		}
+		for obj, size := range sizes {
+			if err = b.Put([]byte(obj), lruValue(now, size)); err != nil {
+				return err
 			}
-			addKeys(k)
-			expiredDataInfo = append(expiredDataInfo, j)
-			return nil
 		}
-	)
-	err := ForEach(bTTL, iterate)
-	if err != nil || len(ttlKeysToDelete) == 0 {
+		return nil
+	})
+	if err != nil {
 		return err
 	}
-	return db.Update(func(tx *bolt.Tx) error {
-		var errs []error
-		for _, j := range expiredDataInfo {
-			if len(j) == 3 { // 1-level bucket
-				if b := tx.Bucket([]byte(j[1].Str)); b != nil {
-					if err = b.Delete([]byte(j[2].Str)); err != nil {
-						errs = append(errs, err)
-					}
-				}
-			} else if len(j) == 4 { // 2-level bucket
-				if b := tx.Bucket([]byte(j[1].Str)); b != nil {
-					if bb := b.Bucket([]byte(j[2].Str)); bb != nil {
-						if err = bb.Delete([]byte(j[3].Str)); err != nil {
-							errs = append(errs, err)
-						}
-					}
-				}
-			}
+	for obj, size := range sizes {
+		items = append(items, &lruItem{obj: obj, size: size, atime: now})
+	}
+	cache.load(items)
+	return nil
+}
+
+// removeObject 在一个事务中删除对象的全部 key 及其 TTL 条目和 lru 记录
+func removeObject(obj string) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		return removeObjectTx(tx, []byte(obj))
+	})
+	if err != nil {
+		return err
+	}
+	cache.remove(obj)
+	return nil
+}
+
+// evictObject 淘汰对象，经过 hook 以便写入队列丢弃对象排队中的写入
+func evictObject(obj string) error {
+	return hook.run(func() ([]string, error) {
+		return []string{obj}, removeObject(obj)
+	})
+}
+
+func removeObjectTx(tx *bolt.Tx, obj []byte) error {
+	i := bytes.IndexByte(obj, ':')
+	if i < 0 {
+		return nil
+	}
+	var (
+		b1     = obj[:i]
+		key    = obj[i+1:]
+		prefix = append(append([]byte{}, key...), ':')
+	)
+	if b := tx.Bucket(b1); b != nil {
+		if err := b.Delete(key); err != nil {
+			return err
 		}
-		// 删除所有对应的 TTL 条目
-		if b := tx.Bucket(bTTL); b != nil {
-			for _, k := range ttlKeysToDelete {
-				if err = b.Delete(k); err != nil {
-					errs = append(errs, err)
-				}
+		if err := delTTL(tx, obj); err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			ttlKey := bytes.Join([][]byte{b1, k}, []byte(":"))
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			if err := delTTL(tx, ttlKey); err != nil {
+				return err
 			}
 		}
-		return errors.Join(errs...)
-	})
+	}
+	if bl := tx.Bucket(bLRU); bl != nil {
+		return bl.Delete(obj)
+	}
+	return nil
 }
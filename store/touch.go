@@ -0,0 +1,64 @@
+package store
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/suconghou/cachelayer/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+// touchInterval 访问记录批量写入存储的间隔，命中缓存时只修改内存，不产生写事务
+const touchInterval = 30 * time.Second
+
+var (
+	touchMu sync.Mutex
+	touched = map[string]int64{} // 对象 -> 需要延长的有效期(秒)，<=0 表示只记录访问时间
+)
+
+// TouchObject 记录一次对象访问，刷新内存中的 LRU 顺序，有效期与访问时间由 flushTouched 定时批量写入
+func TouchObject(b1, obj []byte, ttl int64) {
+	var o = string(objectKey(b1, obj))
+	cache.touch(o, time.Now().Unix())
+	touchMu.Lock()
+	touched[o] = ttl
+	touchMu.Unlock()
+}
+
+// flushTouched 在一个事务中写入积累的访问记录
+func flushTouched() error {
+	touchMu.Lock()
+	pending := touched
+	touched = map[string]int64{}
+	touchMu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	var now = time.Now().Unix()
+	return db.Update(func(tx *bolt.Tx) error {
+		for obj, ttl := range pending {
+			if ttl > 0 {
+				tt, err := json.Marshal([]any{now + ttl, obj})
+				if err != nil {
+					return err
+				}
+				if err = setTTL(tx, []byte(obj), now+ttl, tt); err != nil {
+					return err
+				}
+			}
+			if _, err := account(tx, []byte(obj), 0, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func flushLoop() {
+	for range time.Tick(touchInterval) {
+		if err := flushTouched(); err != nil {
+			util.Log.Print(err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/tidwall/gjson"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	expireBatchSize = 1000                  // 每个事务最多删除的条目数
+	expireBudget    = 50 * time.Millisecond // 每个事务最长占用写锁的时间
+)
+
+func expireIndex(expireAt int64, ttlKey []byte) []byte {
+	k := make([]byte, 8, 8+len(ttlKey))
+	binary.BigEndian.PutUint64(k, uint64(expireAt))
+	return append(k, ttlKey...)
+}
+
+// setTTL 在事务中设置过期时间，同时移除旧的过期索引
+// info 为 [过期时间, bucket..., key] 的 JSON，对象级别的过期为 [过期时间, "bucket:对象"]
+func setTTL(tx *bolt.Tx, ttlKey []byte, expireAt int64, info []byte) error {
+	bt, err := tx.CreateBucketIfNotExists(bTTL)
+	if err != nil {
+		return err
+	}
+	be, err := tx.CreateBucketIfNotExists(bExpire)
+	if err != nil {
+		return err
+	}
+	if old := bt.Get(ttlKey); len(old) == 8 {
+		if err = be.Delete(expireIndex(int64(binary.BigEndian.Uint64(old)), ttlKey)); err != nil {
+			return err
+		}
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(expireAt))
+	if err = bt.Put(ttlKey, v); err != nil {
+		return err
+	}
+	return be.Put(expireIndex(expireAt, ttlKey), info)
+}
+
+// delTTL 在事务中移除 key 的过期时间及其索引
+func delTTL(tx *bolt.Tx, ttlKey []byte) error {
+	bt := tx.Bucket(bTTL)
+	if bt == nil {
+		return nil
+	}
+	old := bt.Get(ttlKey)
+	if old == nil {
+		return nil
+	}
+	if be := tx.Bucket(bExpire); be != nil && len(old) == 8 {
+		if err := be.Delete(expireIndex(int64(binary.BigEndian.Uint64(old)), ttlKey)); err != nil {
+			return err
+		}
+	}
+	return bt.Delete(ttlKey)
+}
+
+// migrateTTL 将旧版本 ttl bucket 中的 JSON 记录转换为按过期时间排序的索引，只在启动时执行一次
+func migrateTTL() error {
+	var legacy = false
+	err := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bTTL); b != nil {
+			k, v := b.Cursor().First()
+			legacy = k != nil && len(v) > 0 && v[0] == '['
+		}
+		return nil
+	})
+	if err != nil || !legacy {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		type entry struct {
+			key  []byte
+			info []byte
+			at   int64
+		}
+		var entries []entry
+		err := tx.Bucket(bTTL).ForEach(func(k, v []byte) error {
+			j := gjson.ParseBytes(v).Array()
+			if len(j) < 2 || len(j) > 4 {
+				return nil
+			}
+			entries = append(entries, entry{bytes.Clone(k), bytes.Clone(v), j[0].Int()})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err = tx.DeleteBucket(bTTL); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err = setTTL(tx, e.key, e.at, e.info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Expire 从最早过期的索引开始删除，遇到未过期的条目即停止
+// 删除分批进行，每个事务受条目数和时长限制，避免长时间占用写锁阻塞其他写入，每批都经过 hook
+func Expire() error {
+	if err := flushTouched(); err != nil { // 先写入内存中的访问记录，避免刚被访问的对象按旧的有效期删除
+		return err
+	}
+	var (
+		now  = time.Now().Unix()
+		done bool
+	)
+	for {
+		err := hook.run(func() ([]string, error) {
+			var (
+				removed []string
+				err     error
+			)
+			done, removed, err = expireOnce(now)
+			return removed, err
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// expireOnce 在一个事务中删除一批过期条目，返回是否已全部删除及整体过期的对象
+func expireOnce(now int64) (bool, []string, error) {
+	var (
+		done    = false
+		sizes   = map[string]int64{}
+		removed []string
+	)
+	err := db.Update(func(tx *bolt.Tx) error {
+		begin := time.Now()
+		be := tx.Bucket(bExpire)
+		if be == nil {
+			done = true
+			return nil
+		}
+		var (
+			bt   = tx.Bucket(bTTL)
+			c    = be.Cursor()
+			errs []error
+		)
+		for n := 0; n < expireBatchSize && time.Since(begin) < expireBudget; n++ {
+			k, v := c.First()
+			if k == nil {
+				done = true
+				break
+			}
+			if len(k) < 8 {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				continue
+			}
+			if int64(binary.BigEndian.Uint64(k[:8])) > now {
+				done = true
+				break
+			}
+			if bt != nil {
+				if err := bt.Delete(bytes.Clone(k[8:])); err != nil {
+					return err
+				}
+			}
+			j := gjson.ParseBytes(v).Array()
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			if len(j) == 2 { // 整个对象过期
+				obj := []byte(j[1].Str)
+				if err := removeObjectTx(tx, obj); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				sizes[string(obj)] = 0
+				removed = append(removed, string(obj))
+			} else if len(j) == 3 { // 1-level bucket
+				b1, key := []byte(j[1].Str), []byte(j[2].Str)
+				if b := tx.Bucket(b1); b != nil {
+					if v := b.Get(key); v != nil {
+						delta := -int64(len(v))
+						if err := b.Delete(key); err != nil {
+							errs = append(errs, err)
+							continue
+						}
+						obj := objectKey(b1, key)
+						size, err := account(tx, obj, delta, 0)
+						if err != nil {
+							errs = append(errs, err)
+							continue
+						}
+						sizes[string(obj)] = size
+					}
+				}
+			} else if len(j) == 4 { // 2-level bucket
+				if b := tx.Bucket([]byte(j[1].Str)); b != nil {
+					if bb := b.Bucket([]byte(j[2].Str)); bb != nil {
+						if err := bb.Delete([]byte(j[3].Str)); err != nil {
+							errs = append(errs, err)
+						}
+					}
+				}
+			}
+		}
+		return errors.Join(errs...)
+	})
+	if err != nil {
+		return true, nil, err
+	}
+	for obj, size := range sizes {
+		cache.set(obj, size, 0)
+	}
+	return done, removed, nil
+}
@@ -4,11 +4,17 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/suconghou/cachelayer/pool"
 )
@@ -17,7 +23,7 @@ var (
 	// Log print to stdout
 	Log        = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
 	cr         = regexp.MustCompile(`\d+/(\d+)`)
-	rq         = regexp.MustCompile(`(\d+)-(\d+)?$`)
+	sz         = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMGT]?)I?B?$`)
 	BufferPool = pool.NewBufferPool(1<<20, 8<<20)
 )
 
@@ -41,17 +47,221 @@ func GetLen(r string) int64 {
 	return l
 }
 
-func GetRange(r string) (int64, int64) {
-	var start, end int64
-	arr := rq.FindStringSubmatch(r)
-	if len(arr) < 2 {
-		return start, end
+// Range 是一个字节范围，Start 与 End 都包含在内
+type Range struct {
+	Start int64
+	End   int64
+}
+
+// ErrUnsatisfiable 表示 Range 头中没有任何一个范围落在对象内
+var ErrUnsatisfiable = errors.New("range not satisfiable")
+
+// maxRanges 合并后范围仍多于此数时忽略 Range 返回完整内容，避免大量小范围放大请求
+const maxRanges = 16
+
+// ParseRange 按 RFC 9110 14.1.2 解析 Range 头，length 为对象大小，支持 start-end、start- 及 -n（最后 n 个字节）
+// 返回 nil 表示没有 Range 或 Range 语法无效应忽略（RFC 9110 14.2），返回完整内容；没有可满足的范围时返回 ErrUnsatisfiable
+// 重叠或间隔很小的范围合并为一个，结果按起始位置排序
+func ParseRange(s string, length int64) ([]Range, error) {
+	unit, set, ok := strings.Cut(s, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, nil
+	}
+	var ranges []Range
+	for _, spec := range strings.Split(set, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, nil
+		}
+		if first == "" { // 最后 n 个字节，n 超过对象大小时为整个对象
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n > 0 && length > 0 {
+				ranges = append(ranges, Range{max(length-n, 0), length - 1})
+			}
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, nil
+		}
+		var end = length - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return nil, nil
+			}
+		}
+		if start >= length { // 起始位置超出对象大小的范围不可满足，结束位置超出时按对象末尾处理
+			continue
+		}
+		ranges = append(ranges, Range{start, min(end, length-1)})
+	}
+	if len(ranges) == 0 {
+		return nil, ErrUnsatisfiable
+	}
+	ranges = coalesce(ranges)
+	if len(ranges) > maxRanges {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// FormatRange 把范围列表格式化为 Range 头
+func FormatRange(ranges []Range) string {
+	var specs = make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		specs = append(specs, strconv.FormatInt(r.Start, 10)+"-"+strconv.FormatInt(r.End, 10))
+	}
+	return "bytes=" + strings.Join(specs, ",")
+}
+
+// coalesce 合并重叠或间隔小于一个分段头开销的范围
+func coalesce(ranges []Range) []Range {
+	const gap = 80
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	var merged = ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.Start <= last.End+gap {
+			last.End = max(last.End, r.End)
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	return merged
+}
+
+// Group 合并同一个 key 的并发调用，只有第一个调用方执行 fn，其余调用方等待并共享其结果
+type Group[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[T]
+}
+
+type call[T any] struct {
+	wg  sync.WaitGroup
+	val T
+}
+
+// Do 执行 fn 并返回其结果，shared 为 true 表示结果来自其他调用方的执行
+func (g *Group[T]) Do(key string, fn func() T) (T, bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*call[T]{}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, true
+	}
+	c := &call[T]{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val = fn()
+	return c.val, false
+}
+
+// ParseSize 解析 200G、512M、1.5T、1024 这样的容量描述，返回字节数
+func ParseSize(s string) (int64, error) {
+	arr := sz.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if arr == nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseFloat(arr[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	switch arr[2] {
+	case "T":
+		n *= 1 << 40
+	case "G":
+		n *= 1 << 30
+	case "M":
+		n *= 1 << 20
+	case "K":
+		n *= 1 << 10
+	}
+	return int64(n), nil
+}
+
+// CacheControl 解析 Cache-Control 头，指令名转为小写，没有值的指令值为空字符串
+func CacheControl(h http.Header) map[string]string {
+	var cc = map[string]string{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, item := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// Vary 解析 Vary 头，返回规范化、去重并排序后的请求头名称
+func Vary(h http.Header) []string {
+	var (
+		names []string
+		seen  = map[string]bool{}
+	)
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MaxAge 返回上游响应头声明的剩余有效期（单位：秒），依次取 s-maxage、max-age、Expires 与 Date 之差，
+// 再减去 Age（响应在上游缓存中已经存放的时间，RFC 9111 4.2.3），没有声明时第二个返回值为 false
+func MaxAge(h http.Header) (int64, bool) {
+	lifetime, ok := freshnessLifetime(h)
+	if !ok {
+		return 0, false
+	}
+	if age, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && age > 0 {
+		lifetime -= age
+	}
+	return max(lifetime, 0), true
+}
+
+func freshnessLifetime(h http.Header) (int64, bool) {
+	var cc = CacheControl(h)
+	for _, k := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[k]; ok {
+			n, err := strconv.ParseInt(v, 10, 64)
+			return max(n, 0), err == nil
+		}
 	}
-	if len(arr) > 2 {
-		end, _ = strconv.ParseInt(arr[2], 10, 64)
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil { // 无效的日期表示已经过期
+			return 0, true
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return max(int64(expires.Sub(date).Seconds()), 0), true
 	}
-	start, _ = strconv.ParseInt(arr[1], 10, 64)
-	return start, end
+	return 0, false
 }
 
 func Md5(b []byte) []byte {
@@ -0,0 +1,114 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	var many []string
+	for i := range maxRanges + 1 {
+		many = append(many, fmt.Sprintf("%d-%d", i*1000, i*1000+9))
+	}
+	var tests = []struct {
+		name   string
+		s      string
+		length int64
+		want   []Range
+		err    error
+	}{
+		{"empty", "", 100, nil, nil},
+		{"single", "bytes=0-9", 100, []Range{{0, 9}}, nil},
+		{"first byte", "bytes=0-0", 100, []Range{{0, 0}}, nil},
+		{"open end", "bytes=90-", 100, []Range{{90, 99}}, nil},
+		{"end beyond length", "bytes=90-200", 100, []Range{{90, 99}}, nil},
+		{"suffix", "bytes=-10", 100, []Range{{90, 99}}, nil},
+		{"suffix beyond length", "bytes=-200", 100, []Range{{0, 99}}, nil},
+		{"unit case and spaces", " Bytes = 0-9 ", 100, []Range{{0, 9}}, nil},
+		{"start beyond length", "bytes=100-", 100, nil, ErrUnsatisfiable},
+		{"zero suffix", "bytes=-0", 100, nil, ErrUnsatisfiable},
+		{"empty object", "bytes=0-0", 0, nil, ErrUnsatisfiable},
+		{"unsatisfiable dropped", "bytes=200-300,0-9", 100, []Range{{0, 9}}, nil},
+		{"other unit", "items=0-9", 100, nil, nil},
+		{"no dash", "bytes=10", 100, nil, nil},
+		{"end before start", "bytes=9-0", 100, nil, nil},
+		{"not a number", "bytes=a-9", 100, nil, nil},
+		{"negative suffix", "bytes=--5", 100, nil, nil},
+		{"one invalid spec", "bytes=0-9,x", 100, nil, nil},
+		{"overlapping", "bytes=0-49,10-20,40-59", 1000, []Range{{0, 59}}, nil},
+		{"small gap", "bytes=80-89,0-9", 1000, []Range{{0, 89}}, nil},
+		{"large gap sorted", "bytes=500-509,0-9", 1000, []Range{{0, 9}, {500, 509}}, nil},
+		{"too many", "bytes=" + strings.Join(many, ","), 1 << 20, nil, nil},
+		{"many coalesced", "bytes=" + strings.Repeat("0-9,", 100) + "0-9", 100, []Range{{0, 9}}, nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseRange(tt.s, tt.length)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: ParseRange(%q, %d) error = %v, want %v", tt.name, tt.s, tt.length, err, tt.err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseRange(%q, %d) = %v, want %v", tt.name, tt.s, tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestParseRangeLimit(t *testing.T) {
+	var specs []string
+	for i := range maxRanges {
+		specs = append(specs, fmt.Sprintf("%d-%d", i*1000, i*1000+9))
+	}
+	got, err := ParseRange("bytes="+strings.Join(specs, ","), 1<<20)
+	if err != nil || len(got) != maxRanges {
+		t.Fatalf("%d ranges: got %d ranges, error %v", maxRanges, len(got), err)
+	}
+	if s := FormatRange(got); s != "bytes="+strings.Join(specs, ",") {
+		t.Fatalf("FormatRange = %q", s)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	var (
+		g       Group[int]
+		calls   atomic.Int32
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+		shared  atomic.Int32
+	)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, ok := g.Do("probe", func() int {
+				calls.Add(1)
+				<-release
+				return 42
+			})
+			if v != 42 {
+				t.Errorf("Do = %d", v)
+			}
+			if ok {
+				shared.Add(1)
+			}
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); calls.Load() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("fn never called")
+		}
+	}
+	time.Sleep(50 * time.Millisecond) // 让其余调用方进入等待
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 || shared.Load() != 4 {
+		t.Fatalf("calls = %d, shared = %d", calls.Load(), shared.Load())
+	}
+	if _, ok := g.Do("probe", func() int { return 1 }); ok { // 完成后的调用重新执行
+		t.Fatal("finished call shared")
+	}
+}
@@ -9,11 +9,16 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"slices"
 	"strings"
 	"time"
+
+	"github.com/suconghou/cachelayer/util"
 )
 
-type vhost struct {
+// Vhost 是一条上游配置，请求路径按 prefix/suffix/keyword 匹配
+type Vhost struct {
 	Prefix      string `json:"prefix"`
 	Suffix      string `json:"suffix"`
 	KeyWord     string `json:"keyword"`
@@ -25,11 +30,66 @@ type vhost struct {
 	CacheSec    uint32 `json:"cachesec"`
 	Timeout     uint32 `json:"timeout"`
 	MaxRedirect uint32 `json:"maxredirect"`
-	client      *http.Client
+
+	// override(默认)：固定使用 cachesec；origin：按上游 Cache-Control/Expires；clamp：上游有效期限制在 minttl 与 maxttl 之间
+	TTLPolicy string `json:"ttlPolicy"`
+	MinTTL    uint32 `json:"minttl"`
+	MaxTTL    uint32 `json:"maxttl"`
+	StaleSec  uint32 `json:"stalesec"` // 过期后继续保留多久用于条件请求重新验证，默认 7 天
+	// RFC 5861：过期不超过 staleWhileRevalidate 秒时先返回旧内容再在后台重新验证，
+	// 过期不超过 staleIfError 秒时上游出错则返回旧内容
+	StaleWhileRevalidate uint32         `json:"staleWhileRevalidate"`
+	StaleIfError         uint32         `json:"staleIfError"`
+	NegativeTTL          map[int]uint32 `json:"negativeTTL"` // 按状态码缓存上游错误响应的秒数，如 {"404": 60}
+
+	ChunkSize  uint32 `json:"chunkSize"`  // 新缓存对象的分片大小(字节)，0 使用默认值，已缓存的对象沿用缓存时的大小
+	Readahead  uint32 `json:"readahead"`  // 顺序读取到请求范围末尾时，后台预取之后的分片数，0 表示不预取
+	FullObject bool   `json:"fullObject"` // 上游不支持range时，边转发边缓存整个对象
+
+	// 缓存时保存到元信息中的响应头，命中缓存时原样返回，不配置时使用默认列表
+	// Content-Type、Accept-Ranges、ETag、Last-Modified、Content-Disposition、Content-Encoding、Cache-Control
+	Headers []string `json:"headers"`
+
+	CacheKey *CacheKey `json:"cacheKey"` // 缓存键规则，不配置时使用完整的上游地址
+	Compress *Compress `json:"compress"` // 按客户端 Accept-Encoding 压缩完整响应，不配置时不压缩
+
+	client *http.Client
+}
+
+// CacheKey 决定哪些部分参与缓存键，只影响缓存键，向上游请求时仍使用完整的原始地址
+type CacheKey struct {
+	DropQuery  []string `json:"dropQuery"`  // 不参与缓存键的参数，支持 utm_* 形式的通配
+	KeepQuery  []string `json:"keepQuery"`  // 配置后只有这些参数参与缓存键
+	SortQuery  bool     `json:"sortQuery"`  // 参数排序后参与缓存键，参数顺序不同的请求共用缓存
+	IgnoreCase bool     `json:"ignoreCase"` // 路径及参数名不区分大小写
+	Headers    []string `json:"headers"`    // 这些请求头的取值也参与缓存键
+	Host       bool     `json:"host"`       // 客户端请求的 Host 也参与缓存键
 }
 
+// Compress 决定哪些响应需要压缩，回源及缓存始终使用未压缩的内容
+type Compress struct {
+	Types   []string `json:"types"`   // 需要压缩的 Content-Type，支持 text/* 形式的通配，不配置时使用默认列表
+	MinSize int64    `json:"minSize"` // 小于该大小(字节)的响应不压缩
+	MaxSize int64    `json:"maxSize"` // 大于该大小(字节)的响应不压缩，0 表示不限制
+}
+
+// 有效期策略
+const (
+	TTLOverride = "override"
+	TTLOrigin   = "origin"
+	TTLClamp    = "clamp"
+)
+
 var (
-	vhosts = []*vhost{}
+	vhosts = []*Vhost{}
+	// 默认压缩的 Content-Type
+	compressTypes = []string{
+		"text/*",
+		"application/javascript",
+		"application/json",
+		"application/xml",
+		"image/svg+xml",
+	}
 	dialer = &net.Dialer{
 		Timeout:   30 * time.Second,
 		KeepAlive: 30 * time.Second,
@@ -44,12 +104,38 @@ func Load(file string) error {
 	if err != nil {
 		return err
 	}
-	var config []*vhost
+	var config []*Vhost
 	err = json.Unmarshal(bs, &config)
 	if err != nil {
 		return err
 	}
 	for _, item := range config {
+		switch item.TTLPolicy {
+		case "":
+			item.TTLPolicy = TTLOverride
+		case TTLOverride, TTLOrigin, TTLClamp:
+		default:
+			return fmt.Errorf("%s: unknown ttlPolicy %q", item.Prefix, item.TTLPolicy)
+		}
+		if len(item.Headers) == 0 {
+			item.Headers = nil
+		}
+		if item.CacheKey != nil {
+			if err := checkPatterns(slices.Concat(item.CacheKey.DropQuery, item.CacheKey.KeepQuery)); err != nil {
+				return fmt.Errorf("%s: cacheKey %w", item.Prefix, err)
+			}
+		}
+		if item.Compress != nil {
+			if len(item.Compress.Types) == 0 {
+				item.Compress.Types = compressTypes
+			}
+			if err := checkPatterns(item.Compress.Types); err != nil {
+				return fmt.Errorf("%s: compress %w", item.Prefix, err)
+			}
+		}
+		if item.StaleSec <= 0 {
+			item.StaleSec = 7 * 86400
+		}
 		if item.Timeout <= 0 {
 			item.Timeout = 60
 		}
@@ -85,16 +171,154 @@ func Load(file string) error {
 }
 
 // Parse got real target by parse vhost
-func Parse(target string) (string, bool, bool, *http.Client, uint32) {
+func Parse(target string) (string, *Vhost) {
 	for _, item := range vhosts {
 		if strings.HasPrefix(target, item.Prefix) && strings.HasSuffix(target, item.Suffix) && strings.Contains(target, item.KeyWord) {
 			if len(item.KeyWord) > 0 {
 				target = strings.Replace(target, item.KeyWord, item.Replace, 1)
 			}
-			return item.Target + target, item.WithQuery, item.StrictCache, item.client, item.CacheSec
+			return item.Target + target, item
+		}
+	}
+	return "", nil
+}
+
+// Client 返回该上游使用的 http.Client
+func (v *Vhost) Client() *http.Client {
+	return v.client
+}
+
+// TTL 根据有效期策略及上游响应头计算缓存有效期（单位：秒），第二个返回值表示响应是否可以缓存
+// 上游声明 no-store、private 或 Vary: * 时任何策略下都不缓存；origin/clamp 策略下上游未声明有效期时使用 cachesec，
+// 计算结果为 0 时不缓存（存储层 0 表示永不过期）
+func (v *Vhost) TTL(h http.Header) (int64, bool) {
+	var cc = util.CacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+	if slices.Contains(util.Vary(h), "*") { // 无法根据请求头区分变体
+		return 0, false
+	}
+	if v.TTLPolicy == TTLOverride {
+		return int64(v.CacheSec), true
+	}
+	ttl, ok := util.MaxAge(h)
+	if !ok {
+		ttl = int64(v.CacheSec)
+	}
+	if v.TTLPolicy == TTLClamp {
+		ttl = max(ttl, int64(v.MinTTL))
+		if v.MaxTTL > 0 {
+			ttl = min(ttl, int64(v.MaxTTL))
+		}
+	}
+	return ttl, ttl > 0
+}
+
+// Retention 返回新鲜期为 ttl 的对象在存储中的保留时间，过期后还保留 stalesec 及 stale 窗口中较长者，ttl<=0 时永久保留
+func (v *Vhost) Retention(ttl int64) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return ttl + int64(max(v.StaleSec, v.StaleWhileRevalidate, v.StaleIfError))
+}
+
+// TouchTTL 返回命中缓存时延长的保留时间，只有 override 策略按访问延长，其余策略以上游声明的有效期为准
+// 访问只延长对象在存储中的保留时间，新鲜期不变，过期后仍需重新验证
+func (v *Vhost) TouchTTL() int64 {
+	if v.TTLPolicy == TTLOverride {
+		return v.Retention(int64(v.CacheSec))
+	}
+	return 0
+}
+
+// Key 按缓存键规则返回 target 的缓存键，h 与 host 为客户端的请求头及 Host，未配置规则时即 target
+func (v *Vhost) Key(target string, h http.Header, host string) string {
+	var k = v.CacheKey
+	if k == nil {
+		return target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	if k.IgnoreCase {
+		u.Path, u.RawPath = strings.ToLower(u.Path), ""
+	}
+	var query []string
+	for _, item := range strings.Split(u.RawQuery, "&") {
+		if item == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(item, "=")
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if k.IgnoreCase {
+			name = strings.ToLower(name)
+		}
+		if (len(k.KeepQuery) > 0 && !k.match(k.KeepQuery, name)) || k.match(k.DropQuery, name) {
+			continue
+		}
+		query = append(query, url.QueryEscape(name)+"="+value)
+	}
+	if k.SortQuery {
+		slices.Sort(query)
+	}
+	u.RawQuery, u.ForceQuery = strings.Join(query, "&"), false
+	var key = u.String()
+	for _, name := range k.Headers {
+		key += "\n" + http.CanonicalHeaderKey(name) + ":" + strings.Join(h.Values(name), ",")
+	}
+	if k.Host {
+		key += "\nHost:" + strings.ToLower(host)
+	}
+	return key
+}
+
+// match 检查参数名是否匹配列表中的任意一项
+func (k *CacheKey) match(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if k.IgnoreCase {
+			p = strings.ToLower(p)
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPatterns 检查通配是否合法
+func checkPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// Compressible 检查内容类型为 contentType、大小为 length 的响应是否需要压缩，length 未知时传 -1，不检查大小
+func (v *Vhost) Compressible(contentType string, length int64) bool {
+	var c = v.Compress
+	if c == nil {
+		return false
+	}
+	if length >= 0 && (length < c.MinSize || (c.MaxSize > 0 && length > c.MaxSize)) {
+		return false
+	}
+	t, _, _ := strings.Cut(contentType, ";")
+	t = strings.ToLower(strings.TrimSpace(t))
+	for _, p := range c.Types {
+		if ok, _ := path.Match(p, t); ok {
+			return true
 		}
 	}
-	return "", false, false, nil, 0
+	return false
 }
 
 func client(timeout uint32, maxredirect uint32, match string, host string) *http.Client {
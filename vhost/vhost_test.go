@@ -0,0 +1,82 @@
+package vhost
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTTL(t *testing.T) {
+	var (
+		override = &Vhost{TTLPolicy: TTLOverride, CacheSec: 100}
+		origin   = &Vhost{TTLPolicy: TTLOrigin, CacheSec: 100}
+		clamp    = &Vhost{TTLPolicy: TTLClamp, CacheSec: 100, MinTTL: 10, MaxTTL: 1000}
+	)
+	var tests = []struct {
+		name string
+		v    *Vhost
+		h    http.Header
+		ttl  int64
+		ok   bool
+	}{
+		{"override ignores max-age", override, http.Header{"Cache-Control": {"max-age=5"}}, 100, true},
+		{"override no-store", override, http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{"override private", override, http.Header{"Cache-Control": {"private, max-age=60"}}, 0, false},
+		{"override vary star", override, http.Header{"Vary": {"*"}}, 0, false},
+		{"origin max-age", origin, http.Header{"Cache-Control": {"max-age=60"}}, 60, true},
+		{"origin s-maxage first", origin, http.Header{"Cache-Control": {"max-age=60, s-maxage=30"}}, 30, true},
+		{"origin expires", origin, http.Header{"Date": {"Mon, 02 Jan 2006 15:04:05 GMT"}, "Expires": {"Mon, 02 Jan 2006 15:05:05 GMT"}}, 60, true},
+		{"origin invalid expires", origin, http.Header{"Expires": {"0"}}, 0, false},
+		{"origin no-cache", origin, http.Header{"Cache-Control": {"no-cache"}}, 100, true},
+		{"origin max-age=0", origin, http.Header{"Cache-Control": {"max-age=0"}}, 0, false},
+		{"origin undeclared", origin, http.Header{}, 100, true},
+		{"origin age", origin, http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, 40, true},
+		{"origin age over max-age", origin, http.Header{"Cache-Control": {"max-age=60"}, "Age": {"90"}}, 0, false},
+		{"origin age with expires", origin, http.Header{"Date": {"Mon, 02 Jan 2006 15:04:05 GMT"}, "Expires": {"Mon, 02 Jan 2006 15:05:05 GMT"}, "Age": {"10"}}, 50, true},
+		{"origin invalid age", origin, http.Header{"Cache-Control": {"max-age=60"}, "Age": {"x"}}, 60, true},
+		{"origin age undeclared", origin, http.Header{"Age": {"20"}}, 100, true},
+		{"clamp below min", clamp, http.Header{"Cache-Control": {"max-age=1"}}, 10, true},
+		{"clamp above max", clamp, http.Header{"Cache-Control": {"max-age=5000"}}, 1000, true},
+		{"clamp within", clamp, http.Header{"Cache-Control": {"max-age=500"}}, 500, true},
+		{"clamp age", clamp, http.Header{"Cache-Control": {"max-age=500"}, "Age": {"100"}}, 400, true},
+		{"clamp age below min", clamp, http.Header{"Cache-Control": {"max-age=500"}, "Age": {"495"}}, 10, true},
+		{"clamp undeclared", clamp, http.Header{}, 100, true},
+		{"clamp no-store", clamp, http.Header{"Cache-Control": {"no-store"}}, 0, false},
+	}
+	for _, tt := range tests {
+		ttl, ok := tt.v.TTL(tt.h)
+		if ttl != tt.ttl || ok != tt.ok {
+			t.Errorf("%s: TTL = %d, %v, want %d, %v", tt.name, ttl, ok, tt.ttl, tt.ok)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	const target = "http://origin/a/B.mp4?utm_source=x&b=2&a=1"
+	var tests = []struct {
+		name   string
+		key    *CacheKey
+		target string
+		h      http.Header
+		host   string
+		want   string
+	}{
+		{"no rule", nil, target, nil, "", target},
+		{"empty rule", &CacheKey{}, target, nil, "", target},
+		{"drop wildcard", &CacheKey{DropQuery: []string{"utm_*"}}, target, nil, "", "http://origin/a/B.mp4?b=2&a=1"},
+		{"keep", &CacheKey{KeepQuery: []string{"a"}}, target, nil, "", "http://origin/a/B.mp4?a=1"},
+		{"keep none", &CacheKey{KeepQuery: []string{"c"}}, target, nil, "", "http://origin/a/B.mp4"},
+		{"sort", &CacheKey{SortQuery: true}, target, nil, "", "http://origin/a/B.mp4?a=1&b=2&utm_source=x"},
+		{"ignore case", &CacheKey{IgnoreCase: true, DropQuery: []string{"UTM_*"}}, "http://origin/A/B.mp4?UTM_x=1&A=1", nil, "", "http://origin/a/b.mp4?a=1"},
+		{"escaped name", &CacheKey{DropQuery: []string{"a b"}}, "http://origin/p?a%20b=1&c=2", nil, "", "http://origin/p?c=2"},
+		{"empty query", &CacheKey{DropQuery: []string{"x"}}, "http://origin/p?", nil, "", "http://origin/p"},
+		{"headers", &CacheKey{Headers: []string{"x-device"}}, "http://origin/p", http.Header{"X-Device": {"tv", "phone"}}, "", "http://origin/p\nX-Device:tv,phone"},
+		{"missing header", &CacheKey{Headers: []string{"X-Device"}}, "http://origin/p", http.Header{}, "", "http://origin/p\nX-Device:"},
+		{"host", &CacheKey{Host: true}, "http://origin/p", nil, "Example.COM", "http://origin/p\nHost:example.com"},
+	}
+	for _, tt := range tests {
+		var v = &Vhost{CacheKey: tt.key}
+		if got := v.Key(tt.target, tt.h, tt.host); got != tt.want {
+			t.Errorf("%s: Key = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}